@@ -0,0 +1,73 @@
+// Copyright (c) 2019-2020 KIDTSUNAMI
+// Author: alex@kidtsunami.com
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/echa/serve/server"
+)
+
+// render prints a template file below the server root with all placeholders
+// replaced. Files of additional mounts are addressed by their base path.
+// Values are masked unless -unmask is given.
+func render(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: serve [flags] render <file>")
+	}
+	mux, err := server.LoadMux()
+	if err != nil {
+		return err
+	}
+	spa, name := mux.Mount(args[0])
+	return spa.Render(os.Stdout, name, !unmask)
+}
+
+// templates lists all placeholders in template files below the server roots,
+// extra headers and cache rules with their status and fails when any
+// placeholder is unresolved. Files of additional mounts are prefixed with
+// their base path.
+func templates() error {
+	mux, err := server.LoadMux()
+	if err != nil {
+		return err
+	}
+	var refs []server.TemplateRef
+	for _, spa := range mux.Servers() {
+		list, err := spa.TemplateReport()
+		if err != nil {
+			return err
+		}
+		if spa != mux.Main() {
+			for i, r := range list {
+				if strings.HasPrefix(r.File, "/") {
+					list[i].File = path.Join(spa.Base(), r.File)
+				} else {
+					// headers and cache rules
+					list[i].File = spa.Base() + " " + r.File
+				}
+			}
+		}
+		refs = append(refs, list...)
+	}
+	var (
+		files      = make(map[string]bool)
+		unresolved int
+	)
+	for _, r := range refs {
+		fmt.Println(r)
+		files[r.File] = true
+		if r.IsProblem() {
+			unresolved++
+		}
+	}
+	fmt.Printf("%d placeholders in %d files, %d unresolved\n", len(refs), len(files), unresolved)
+	if unresolved > 0 {
+		return fmt.Errorf("%d unresolved placeholders", unresolved)
+	}
+	return nil
+}
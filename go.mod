@@ -3,6 +3,8 @@ module github.com/echa/serve
 go 1.13
 
 require (
+	github.com/andybalholm/brotli v1.0.6
 	github.com/echa/config v1.0.1
 	github.com/echa/log v1.0.0
+	gopkg.in/yaml.v3 v3.0.1
 )
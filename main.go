@@ -9,6 +9,7 @@
 // - HTTP/1.1 and HTTP/2.0 support
 // - TLS server support
 // - multi-language index.html from Accept-Language header
+// - multiple apps mounted under different base paths
 // - template replacement from env variables for safe secrets injection
 // - custom HTTP headers
 // - custom HTTP cache settings
@@ -40,6 +41,8 @@ var (
 	vdebug  bool
 	vtrace  bool
 	vstats  int
+	// show template values in render output
+	unmask bool
 )
 
 func init() {
@@ -48,6 +51,7 @@ func init() {
 	flags.BoolVar(&vquiet, "q", false, "be quiet")
 	flags.BoolVar(&vdebug, "d", false, "debug mode")
 	flags.BoolVar(&vtrace, "t", false, "trace mode")
+	flags.BoolVar(&unmask, "unmask", false, "show template values in render output")
 
 	// defaults
 	config.SetEnvPrefix("SV")
@@ -61,6 +65,11 @@ func main() {
 	if err := flags.Parse(os.Args[1:]); err != nil {
 		if err == flag.ErrHelp {
 			fmt.Println("Simple HTTP Fileserver")
+			fmt.Println("\nUsage: serve [flags] [command]")
+			fmt.Println("\nCommands:")
+			fmt.Println("  render <file>  print a template file with values replaced")
+			fmt.Println("  templates      list all template placeholders and their status")
+			fmt.Println("\nFlags:")
 			flags.PrintDefaults()
 			os.Exit(0)
 		}
@@ -68,14 +77,12 @@ func main() {
 	}
 	// read config file
 	realconf := config.ConfigName()
-	log.Info("Using config file ", realconf)
-	if _, err := os.Stat(realconf); err == nil {
+	_, staterr := os.Stat(realconf)
+	if staterr == nil {
 		if err := config.ReadConfigFile(); err != nil {
 			fmt.Printf("Could not read %s: %v\n", realconf, err)
 			os.Exit(1)
 		}
-	} else {
-		log.Warn("Missing config file, using default values.")
 	}
 
 	// change log level
@@ -99,10 +106,29 @@ func main() {
 	cfg.Facility = config.GetString("logging.syslog.facility")
 	cfg.Ident = config.GetString("logging.syslog.ident")
 	cfg.FileMode = os.FileMode(config.GetInt("logging.filemode"))
+	// keep command output separate from logs
+	if flags.NArg() > 0 && cfg.Backend == "stdout" {
+		cfg.Backend = "stderr"
+	}
 	log.Init(cfg)
+	log.Info("Using config file ", realconf)
+	if staterr != nil {
+		log.Warn("Missing config file, using default values.")
+	}
 
 	// run
-	if err := run(); err != nil {
+	var err error
+	switch cmd := flags.Arg(0); cmd {
+	case "":
+		err = run()
+	case "render":
+		err = render(flags.Args()[1:])
+	case "templates":
+		err = templates()
+	default:
+		err = fmt.Errorf("unknown command '%s'", cmd)
+	}
+	if err != nil {
 		log.Fatal(err)
 	}
 }
@@ -111,18 +137,21 @@ func run() error {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// reload template values on SIGHUP, it no longer stops the server
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
 	errch := make(chan error, 1)
 	var wg sync.WaitGroup
+	wg.Add(1)
 	go func() {
-		wg.Add(1)
 		defer wg.Done()
-		errch <- serve(ctx)
+		errch <- serve(ctx, hup)
 	}()
 
 	// wait for Ctrl-C
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop,
-		syscall.SIGHUP,
 		syscall.SIGINT,
 		syscall.SIGTERM,
 		syscall.SIGQUIT,
@@ -146,16 +175,17 @@ func run() error {
 	return nil
 }
 
-func serve(ctx context.Context) error {
-	spa, err := server.NewSPAServer()
+func serve(ctx context.Context, hup <-chan os.Signal) error {
+	mux, err := server.NewMux()
 	if err != nil {
 		return err
 	}
+	defer mux.Close()
 
 	s := &http.Server{
-		Addr:              spa.Address(),
-		TLSConfig:         spa.TLS(),
-		Handler:           spa,
+		Addr:              mux.Address(),
+		TLSConfig:         mux.TLS(),
+		Handler:           mux,
 		ReadHeaderTimeout: config.GetDuration("server.header_timeout"),
 		ReadTimeout:       config.GetDuration("server.read_timeout"),
 		WriteTimeout:      config.GetDuration("server.write_timeout"),
@@ -170,19 +200,22 @@ func serve(ctx context.Context) error {
 	go func() {
 		errch <- s.ListenAndServe()
 	}()
-	select {
-	case err := <-errch:
-		return err
-	case <-ctx.Done():
-		log.Info("Stopping HTTP server.")
-		ctx2, cancel := context.WithCancel(context.Background())
-		if tm := config.GetDuration("server.shutdown_timeout"); tm > 0 {
-			ctx2, cancel = context.WithTimeout(ctx2, tm)
-			defer cancel()
-		}
-		if err := s.Shutdown(ctx2); err != nil {
+	for {
+		select {
+		case err := <-errch:
 			return err
+		case <-hup:
+			if err := mux.Reload(); err != nil {
+				log.Errorf("Reload failed: %v", err)
+			}
+		case <-ctx.Done():
+			log.Info("Stopping HTTP server.")
+			ctx2, cancel := context.WithCancel(context.Background())
+			if tm := config.GetDuration("server.shutdown_timeout"); tm > 0 {
+				ctx2, cancel = context.WithTimeout(ctx2, tm)
+				defer cancel()
+			}
+			return s.Shutdown(ctx2)
 		}
 	}
-	return nil
 }
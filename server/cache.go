@@ -0,0 +1,247 @@
+// Copyright (c) 2019-2020 KIDTSUNAMI
+// Author: alex@kidtsunami.com
+
+package server
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/echa/log"
+)
+
+// FileCache is a concurrency-safe in-memory store for cached files. Entries
+// are immutable after insert, every lookup returns a private copy with its
+// own read offset. Concurrent loads for the same name are collapsed into a
+// single call so a burst of cold requests opens and renders a file once.
+//
+// The cache is bounded by a total memory budget and an optional entry count.
+// When a limit is exceeded, least recently used entries are evicted first.
+// Pinned entries are never evicted, but count towards the budget.
+type FileCache struct {
+	mu       sync.Mutex
+	files    map[string]*cacheEntry
+	lru      *list.List // unpinned entries, most recently used first
+	calls    map[string]*loadCall
+	size     int64
+	maxSize  int64
+	maxFiles int
+}
+
+type cacheEntry struct {
+	name string
+	file *CachedFile
+	pin  bool
+	elem *list.Element
+}
+
+type loadCall struct {
+	wg    sync.WaitGroup
+	f     *CachedFile
+	err   error
+	stale bool // removed while loading, don't store result
+}
+
+// NewFileCache creates a cache that holds at most maxSize bytes and maxFiles
+// entries. A zero limit disables the respective check.
+func NewFileCache(maxSize int64, maxFiles int) *FileCache {
+	return &FileCache{
+		files:    make(map[string]*cacheEntry),
+		lru:      list.New(),
+		calls:    make(map[string]*loadCall),
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+}
+
+// Len returns the number of cached files.
+func (c *FileCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.files)
+}
+
+// Size returns the total memory used by cached files in bytes.
+func (c *FileCache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// Get returns a private copy of a cached file or nil when the file is not
+// cached.
+func (c *FileCache) Get(name string) *CachedFile {
+	c.mu.Lock()
+	e, ok := c.files[name]
+	if ok && e.elem != nil {
+		c.lru.MoveToFront(e.elem)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return e.file.Clone()
+}
+
+// Add stores a file under name, replacing any existing entry. Pinned files
+// are never evicted.
+func (c *FileCache) Add(name string, f *CachedFile, pin bool) {
+	c.mu.Lock()
+	c.add(name, f, pin)
+	c.mu.Unlock()
+}
+
+// Names returns the names of all cached files.
+func (c *FileCache) Names() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	names := make([]string, 0, len(c.files))
+	for n := range c.files {
+		names = append(names, n)
+	}
+	return names
+}
+
+// Remove drops a file from cache. A load for this file that is currently in
+// flight will not be stored because its contents may be outdated.
+func (c *FileCache) Remove(name string) {
+	c.mu.Lock()
+	if e, ok := c.files[name]; ok {
+		c.remove(e)
+	}
+	if call, ok := c.calls[name]; ok {
+		call.stale = true
+		delete(c.calls, name)
+	}
+	c.mu.Unlock()
+}
+
+// Load returns a cached file or calls fn to load it. Only one call to fn is
+// in flight for a given name, concurrent callers wait for and share its
+// result. Successfully loaded files are stored in cache.
+func (c *FileCache) Load(name string, pin bool, fn func() (*CachedFile, error)) (*CachedFile, error) {
+	c.mu.Lock()
+	if e, ok := c.files[name]; ok {
+		if e.elem != nil {
+			c.lru.MoveToFront(e.elem)
+		}
+		c.mu.Unlock()
+		return e.file.Clone(), nil
+	}
+	if call, ok := c.calls[name]; ok {
+		c.mu.Unlock()
+		call.wg.Wait()
+		if call.err != nil {
+			return nil, call.err
+		}
+		return call.f.Clone(), nil
+	}
+	call := &loadCall{}
+	call.wg.Add(1)
+	c.calls[name] = call
+	c.mu.Unlock()
+
+	call.f, call.err = fn()
+
+	c.mu.Lock()
+	if !call.stale {
+		delete(c.calls, name)
+		if call.err == nil {
+			c.add(name, call.f, pin)
+		}
+	}
+	c.mu.Unlock()
+	call.wg.Done()
+
+	if call.err != nil {
+		return nil, call.err
+	}
+	return call.f.Clone(), nil
+}
+
+// add inserts an entry and evicts least recently used entries until the
+// cache is back within its limits. Unpinned files larger than the entire
+// budget are not stored at all. Must be called with c.mu held.
+func (c *FileCache) add(name string, f *CachedFile, pin bool) {
+	if e, ok := c.files[name]; ok {
+		c.remove(e)
+	}
+	sz := f.memsize()
+	if !pin && c.maxSize > 0 && sz > c.maxSize {
+		log.Debugf("Not caching file %s: %d bytes exceed cache budget", name, sz)
+		return
+	}
+	e := &cacheEntry{name: name, file: f, pin: pin}
+	if !pin {
+		e.elem = c.lru.PushFront(e)
+	}
+	c.files[name] = e
+	c.size += sz
+	for c.lru.Len() > 0 && c.full() {
+		old := c.lru.Back().Value.(*cacheEntry)
+		log.Debugf("Evicting file %s from cache", old.name)
+		c.remove(old)
+	}
+}
+
+func (c *FileCache) full() bool {
+	return (c.maxSize > 0 && c.size > c.maxSize) ||
+		(c.maxFiles > 0 && len(c.files) > c.maxFiles)
+}
+
+// remove drops an entry. Must be called with c.mu held.
+func (c *FileCache) remove(e *cacheEntry) {
+	if e.elem != nil {
+		c.lru.Remove(e.elem)
+	}
+	delete(c.files, e.name)
+	c.size -= e.file.memsize()
+}
+
+// ResolveCache remembers which file a request path was resolved to, so
+// repeated requests for SPA routes skip the filesystem probes of the
+// fallback chain. It is bounded by a max number of entries and reset when
+// full.
+type ResolveCache struct {
+	mu    sync.RWMutex
+	names map[string]string
+	max   int
+}
+
+// NewResolveCache creates a resolution cache with at most max entries. A zero
+// limit disables the cache.
+func NewResolveCache(max int) *ResolveCache {
+	return &ResolveCache{
+		names: make(map[string]string),
+		max:   max,
+	}
+}
+
+// Get returns the file name a key resolved to.
+func (c *ResolveCache) Get(key string) (string, bool) {
+	c.mu.RLock()
+	name, ok := c.names[key]
+	c.mu.RUnlock()
+	return name, ok
+}
+
+// Add stores the file name a key resolved to.
+func (c *ResolveCache) Add(key, name string) {
+	if c.max <= 0 {
+		return
+	}
+	c.mu.Lock()
+	if len(c.names) >= c.max {
+		log.Debugf("Resetting full resolve cache")
+		c.names = make(map[string]string)
+	}
+	c.names[key] = name
+	c.mu.Unlock()
+}
+
+// Reset removes all entries.
+func (c *ResolveCache) Reset() {
+	c.mu.Lock()
+	c.names = make(map[string]string)
+	c.mu.Unlock()
+}
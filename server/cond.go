@@ -0,0 +1,182 @@
+// Copyright (c) 2019-2020 KIDTSUNAMI
+// Author: alex@kidtsunami.com
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// template directives for conditional sections
+const (
+	directiveIf   = "if"
+	directiveElse = "else"
+	directiveEnd  = "end"
+)
+
+// Condition is the expression of an if directive, one of `KEY`, `!KEY`,
+// `KEY == value` or `KEY != value`. Values may be quoted.
+type Condition struct {
+	Key   string
+	Op    string // empty, `==` or `!=`
+	Value string
+	Not   bool
+}
+
+// Eval evaluates a condition against the value of its variable. Without
+// operator a condition is true when the variable is defined and its value is
+// not empty, `0`, `false`, `no` or `off`.
+func (c Condition) Eval(val string, ok bool) bool {
+	var res bool
+	switch c.Op {
+	case "==":
+		res = val == c.Value
+	case "!=":
+		res = val != c.Value
+	default:
+		res = ok && isTrue(val)
+	}
+	return res != c.Not
+}
+
+func isTrue(val string) bool {
+	switch strings.ToLower(strings.TrimSpace(val)) {
+	case "", "0", "false", "no", "off":
+		return false
+	default:
+		return true
+	}
+}
+
+// ParseDirective parses the text between template delimiters as directive.
+// It returns an empty kind when the text is a regular placeholder.
+func ParseDirective(s string) (string, Condition, error) {
+	var c Condition
+	s = strings.TrimSpace(s)
+	switch s {
+	case directiveElse, directiveEnd:
+		return s, c, nil
+	}
+	if s != directiveIf && !strings.HasPrefix(s, directiveIf+" ") {
+		return "", c, nil
+	}
+	expr := strings.TrimSpace(strings.TrimPrefix(s, directiveIf))
+	for _, op := range []string{"==", "!="} {
+		if i := strings.Index(expr, op); i >= 0 {
+			c.Key, c.Op = strings.TrimSpace(expr[:i]), op
+			c.Value = strings.TrimSpace(expr[i+len(op):])
+			if len(c.Value) > 1 && (c.Value[0] == '"' || c.Value[0] == '\'') && c.Value[len(c.Value)-1] == c.Value[0] {
+				if c.Value[0] == '"' {
+					v, err := strconv.Unquote(c.Value)
+					if err != nil {
+						return directiveIf, c, fmt.Errorf("invalid value %s", c.Value)
+					}
+					c.Value = v
+				} else {
+					c.Value = c.Value[1 : len(c.Value)-1]
+				}
+			}
+			break
+		}
+	}
+	if c.Op == "" {
+		c.Key = expr
+		if strings.HasPrefix(expr, "!") {
+			c.Key, c.Not = strings.TrimSpace(expr[1:]), true
+		}
+	}
+	if c.Key == "" || strings.ContainsAny(c.Key, " \t|") {
+		return directiveIf, c, fmt.Errorf("invalid condition '%s'", expr)
+	}
+	if isRequestKey(c.Key) {
+		return directiveIf, c, fmt.Errorf("conditions on request variables are not supported")
+	}
+	return directiveIf, c, nil
+}
+
+// Sections tracks nested conditional sections while a template is
+// processed. Text and placeholders are only output while all enclosing
+// sections are active.
+type Sections struct {
+	eval  func(Condition) bool
+	stack []section
+}
+
+type section struct {
+	cond   bool // condition result
+	parent bool // enclosing sections are active
+	inElse bool
+}
+
+func NewSections(eval func(Condition) bool) *Sections {
+	return &Sections{eval: eval}
+}
+
+// Active returns true when output is enabled at the current position.
+func (x *Sections) Active() bool {
+	if len(x.stack) == 0 {
+		return true
+	}
+	s := x.stack[len(x.stack)-1]
+	return s.parent && s.cond != s.inElse
+}
+
+// Handle processes the text of a placeholder. It returns false when the
+// text is not a directive and an error for invalid directives or nesting.
+func (x *Sections) Handle(text string) (bool, error) {
+	kind, cond, err := ParseDirective(text)
+	if kind == "" {
+		return false, nil
+	}
+	if err != nil {
+		return true, err
+	}
+	switch kind {
+	case directiveIf:
+		s := section{parent: x.Active()}
+		// skip lookups in inactive sections
+		if s.parent {
+			s.cond = x.eval(cond)
+		}
+		x.stack = append(x.stack, s)
+	case directiveElse:
+		if len(x.stack) == 0 {
+			return true, fmt.Errorf("else without if")
+		}
+		s := &x.stack[len(x.stack)-1]
+		if s.inElse {
+			return true, fmt.Errorf("duplicate else")
+		}
+		s.inElse = true
+	case directiveEnd:
+		if len(x.stack) == 0 {
+			return true, fmt.Errorf("end without if")
+		}
+		x.stack = x.stack[:len(x.stack)-1]
+	}
+	return true, nil
+}
+
+// Close fails when sections are left open.
+func (x *Sections) Close() error {
+	if n := len(x.stack); n > 0 {
+		return fmt.Errorf("%d unclosed if", n)
+	}
+	return nil
+}
+
+// sectionWriter drops writes while the current section is inactive.
+type sectionWriter struct {
+	w   io.Writer
+	sec *Sections
+}
+
+func (w sectionWriter) Write(p []byte) (int, error) {
+	if !w.sec.Active() {
+		return len(p), nil
+	}
+	return w.w.Write(p)
+}
@@ -0,0 +1,196 @@
+// Copyright (c) 2019-2020 KIDTSUNAMI
+// Author: alex@kidtsunami.com
+
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// file extensions of precompressed sibling files by content encoding
+var encodingExt = map[string]string{
+	"br":   ".br",
+	"gzip": ".gz",
+	"zstd": ".zst",
+}
+
+// content encodings supported for on-the-fly compression
+var compressors = map[string]func(io.Writer) io.WriteCloser{
+	"br": func(w io.Writer) io.WriteCloser {
+		return brotli.NewWriterLevel(w, brotli.DefaultCompression)
+	},
+	"gzip": func(w io.Writer) io.WriteCloser {
+		zw, _ := gzip.NewWriterLevel(w, gzip.BestCompression)
+		return zw
+	},
+}
+
+func CheckEncodings(encs []string) error {
+	for _, v := range encs {
+		if _, ok := encodingExt[v]; !ok {
+			return fmt.Errorf("unsupported content encoding '%s'", v)
+		}
+	}
+	return nil
+}
+
+func CheckCompressors(encs []string) error {
+	for _, v := range encs {
+		if _, ok := compressors[v]; !ok {
+			return fmt.Errorf("unsupported content encoding '%s'", v)
+		}
+	}
+	return nil
+}
+
+// Compress returns buf compressed with the given content encoding.
+func Compress(enc string, buf []byte) ([]byte, error) {
+	fn, ok := compressors[enc]
+	if !ok {
+		return nil, fmt.Errorf("unsupported content encoding '%s'", enc)
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(buf)/2))
+	w := fn(out)
+	if _, err := w.Write(buf); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// contentType returns the MIME type for a file name based on its extension.
+func contentType(name string) string {
+	ctype := mime.TypeByExtension(path.Ext(name))
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+	return ctype
+}
+
+// addVary adds a header name to the Vary response header unless present.
+func addVary(h http.Header, name string) {
+	for _, v := range h["Vary"] {
+		for _, f := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(f), name) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", name)
+}
+
+// ParseAcceptEncoding returns the quality value for each content coding
+// listed in an Accept-Encoding header. Codings without q parameter have a
+// quality of 1.
+func ParseAcceptEncoding(h string) map[string]float64 {
+	m := make(map[string]float64)
+	for _, v := range strings.Split(h, ",") {
+		fields := strings.Split(v, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, p := range fields[1:] {
+			p = strings.TrimSpace(p)
+			if !strings.HasPrefix(p, "q=") {
+				continue
+			}
+			if f, err := strconv.ParseFloat(p[2:], 64); err == nil {
+				q = f
+			}
+		}
+		m[coding] = q
+	}
+	return m
+}
+
+// NegotiateEncoding returns all offered content codings that are acceptable
+// according to an Accept-Encoding header, ordered by client preference. Offers
+// of equal quality keep the server's order.
+func NegotiateEncoding(h string, offers []string) []string {
+	if h == "" || len(offers) == 0 {
+		return nil
+	}
+	accept := ParseAcceptEncoding(h)
+	quality := func(enc string) float64 {
+		if q, ok := accept[enc]; ok {
+			return q
+		}
+		if q, ok := accept["*"]; ok {
+			return q
+		}
+		return 0
+	}
+	encs := make([]string, 0, len(offers))
+	for _, v := range offers {
+		if quality(v) > 0 {
+			encs = append(encs, v)
+		}
+	}
+	sort.SliceStable(encs, func(i, j int) bool {
+		return quality(encs[i]) > quality(encs[j])
+	})
+	return encs
+}
+
+// usePrecompressed returns true when a file may be served from precompressed
+// siblings. Template files are never served precompressed because siblings
+// contain unreplaced placeholders.
+func (s *SPAServer) usePrecompressed(name string) bool {
+	return len(s.cfg.Compress.Precompressed) > 0 && !s.isTemplate(name)
+}
+
+// useCompression returns true when compressed variants of a cached file
+// should be kept, based on minimum file size and MIME type allowlist.
+func (s *SPAServer) useCompression(name string, size int64) bool {
+	c := s.cfg.Compress
+	if !c.Enable || len(c.Encodings) == 0 || size < c.MinSize {
+		return false
+	}
+	ctype := contentType(name)
+	if i := strings.Index(ctype, ";"); i >= 0 {
+		ctype = ctype[:i]
+	}
+	for _, v := range c.Types {
+		if strings.EqualFold(v, ctype) {
+			return true
+		}
+	}
+	return false
+}
+
+// TryEncoded tries to open a precompressed sibling of a file in the best
+// content encoding acceptable to the client. It returns the open file, its
+// name and content encoding or a nil file when no sibling exists. Missing
+// siblings are remembered like path resolutions.
+func (s *SPAServer) TryEncoded(r *http.Request, name string) (http.File, string, string, error) {
+	// serve ranges from the original file only
+	if r.Header.Get("Range") != "" {
+		return nil, "", "", nil
+	}
+	for _, enc := range NegotiateEncoding(r.Header.Get("Accept-Encoding"), s.cfg.Compress.Precompressed) {
+		ename := name + encodingExt[enc]
+		if _, ok := s.absent.Get(ename); ok {
+			continue
+		}
+		if f, err := s.probe(ename); f != nil || err != nil {
+			return f, ename, enc, err
+		}
+		s.absent.Add(ename, "")
+	}
+	return nil, "", "", nil
+}
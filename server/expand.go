@@ -0,0 +1,117 @@
+// Copyright (c) 2019-2020 KIDTSUNAMI
+// Author: alex@kidtsunami.com
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/echa/log"
+)
+
+// expandedConfig holds extra headers and cache rules with template
+// placeholders replaced. It is rebuilt on reload and replaced atomically.
+type expandedConfig struct {
+	headers map[string]string
+	rules   []CacheRule
+}
+
+func (s *SPAServer) expanded() *expandedConfig {
+	c, _ := s.conf.Load().(*expandedConfig)
+	return c
+}
+
+// Values returns the current template value sources.
+func (s *SPAServer) Values() *Values {
+	v, _ := s.values.Load().(*Values)
+	return v
+}
+
+// expandString replaces placeholders in a config value using the same value
+// sources, allowlist, filters and conditional sections as file templates.
+// Values are not escaped by default. Request-specific placeholders are kept
+// for rendering them per request.
+func (s *SPAServer) expandString(name, v string, missing MissingError) (string, error) {
+	var buf bytes.Buffer
+	r := s.newReplacer(name, "raw")
+	r.missing = missing
+	FindAndReplace([]byte(v), sectionWriter{w: &buf, sec: r.sec}, r.Replace)
+	// missing variables are reported by the caller
+	r.missing = nil
+	return buf.String(), r.Close()
+}
+
+// expandConfig replaces placeholders in extra header values and cache rule
+// `control` strings and fails when required variables are missing.
+func (s *SPAServer) expandConfig() error {
+	var (
+		missing = make(MissingError)
+		c       = &expandedConfig{
+			headers: make(map[string]string, len(s.headers)),
+			rules:   make([]CacheRule, len(s.cfg.Cache.Rules)),
+		}
+		err error
+	)
+	for n, v := range s.headers {
+		if c.headers[n], err = s.expandString("header "+n, v, missing); err != nil {
+			return err
+		}
+	}
+	if err := CheckHeaders(c.headers); err != nil {
+		return fmt.Errorf("headers: %v", err)
+	}
+	for i, v := range s.cfg.Cache.Rules {
+		name := fmt.Sprintf("cache rule %d", i)
+		if v.Control, err = s.expandString(name, v.Control, missing); err != nil {
+			return err
+		}
+		c.rules[i] = v
+	}
+	if len(missing) > 0 {
+		return missing
+	}
+	s.conf.Store(c)
+	return nil
+}
+
+// Reload reloads template value sources and the runtime config file,
+// replaces placeholders in headers and cache rules again and refreshes all
+// cached files. Templates are validated against the new values before they
+// are used. On error the current values and configuration are kept.
+func (s *SPAServer) Reload() error {
+	var rt *CachedFile
+	if s.cfg.Runtime.Enable {
+		var err error
+		if rt, err = s.loadRuntimeConfig(); err != nil {
+			return fmt.Errorf("runtime: %v", err)
+		}
+	}
+	values, err := NewValuesFromConfig()
+	if err != nil {
+		return err
+	}
+
+	// expand and validate on a copy so requests never see values that
+	// fail validation
+	next := &SPAServer{
+		cfg:     s.cfg,
+		headers: s.headers,
+		root:    s.root,
+	}
+	next.values.Store(values)
+	if err := next.expandConfig(); err != nil {
+		return err
+	}
+	if err := next.CheckTemplates(); err != nil {
+		return err
+	}
+	s.values.Store(values)
+	s.conf.Store(next.expanded())
+	if rt != nil {
+		s.runtime.Store(rt)
+	}
+	s.refresh("/")
+	log.Info("Reloaded template values")
+	return nil
+}
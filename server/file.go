@@ -5,26 +5,39 @@ package server
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
-	"github.com/echa/log"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
-	"strings"
 	"time"
 )
 
 // Du to the use of bytes.Reader max file size will be limited to 2^32
 // and practically to a much lower user defined value. This helps prevent
-// heap memory exhaustion.
+// heap memory exhaustion. Larger files are either memory mapped or served
+// from disk.
 var MaxFileSize int64 = 1 << 24 // 16 MB
 
 type CachedFile struct {
 	buf []byte
 	rd  *bytes.Reader
 	fi  *CachedFileInfo
+	sum [sha256.Size]byte // content hash for ETag and digest headers
+	tag string            // ETag suffix for compressed variants
+	enc []encodedBuffer   // compressed variants in order of preference
+	mm  *mmapData         // memory mapping backing buf, if any
+	tpl *requestTemplate  // placeholders rendered per request, if any
+}
+
+type encodedBuffer struct {
+	enc string
+	buf []byte
+	sum [sha256.Size]byte
 }
 
 type CachedFileInfo struct {
@@ -62,19 +75,147 @@ func NewCachedFile(f http.File) (*CachedFile, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &CachedFile{buf: buf, rd: bytes.NewReader(buf), fi: NewCachedFileInfo(fi)}, nil
+	return &CachedFile{
+		buf: buf,
+		rd:  bytes.NewReader(buf),
+		fi:  NewCachedFileInfo(fi),
+		sum: sha256.Sum256(buf),
+	}, nil
+}
+
+// NewMappedFile maps a large read-only file into memory instead of reading
+// it onto the heap. Mapped files are neither template-replaced nor compressed
+// and are only identified by weak ETags.
+func NewMappedFile(f http.File) (*CachedFile, error) {
+	osf, ok := f.(*os.File)
+	if !ok {
+		return nil, os.ErrInvalid
+	}
+	fi, err := osf.Stat()
+	if err != nil {
+		return nil, err
+	}
+	m, err := mmapFile(osf, fi.Size())
+	if err != nil {
+		return nil, err
+	}
+	return &CachedFile{
+		buf: m.buf,
+		rd:  bytes.NewReader(m.buf),
+		fi:  NewCachedFileInfo(fi),
+		mm:  m,
+	}, nil
 }
 
 func NewCachedBuffer(name string, buf []byte) (*CachedFile, error) {
 	if int64(len(buf)) > MaxFileSize {
 		return nil, io.ErrShortBuffer
 	}
-	return &CachedFile{buf: buf, rd: bytes.NewReader(buf), fi: &CachedFileInfo{
-		name:    name,
-		size:    int64(len(buf)),
-		mode:    0444,
-		modtime: time.Now().UTC(),
-	}}, nil
+	return &CachedFile{
+		buf: buf,
+		rd:  bytes.NewReader(buf),
+		fi: &CachedFileInfo{
+			name:    name,
+			size:    int64(len(buf)),
+			mode:    0444,
+			modtime: time.Now().UTC(),
+		},
+		sum: sha256.Sum256(buf),
+	}, nil
+}
+
+// Clone returns a copy of f that shares the immutable file contents but
+// has its own read offset, so it can be served concurrently with f.
+func (f *CachedFile) Clone() *CachedFile {
+	return &CachedFile{
+		buf: f.buf,
+		rd:  bytes.NewReader(f.buf),
+		fi:  f.fi,
+		sum: f.sum,
+		tag: f.tag,
+		enc: f.enc,
+		mm:  f.mm,
+		tpl: f.tpl,
+	}
+}
+
+// memsize returns the number of bytes a cached file keeps in memory.
+func (f *CachedFile) memsize() int64 {
+	sz := int64(len(f.buf))
+	for _, v := range f.enc {
+		sz += int64(len(v.buf))
+	}
+	return sz
+}
+
+// Compress stores compressed variants of the file contents for each content
+// encoding. Variants that are not smaller than the original are dropped.
+func (f *CachedFile) Compress(encs []string) error {
+	f.enc = nil
+	for _, enc := range encs {
+		buf, err := Compress(enc, f.buf)
+		if err != nil {
+			return err
+		}
+		if len(buf) >= len(f.buf) {
+			continue
+		}
+		f.enc = append(f.enc, encodedBuffer{enc: enc, buf: buf, sum: sha256.Sum256(buf)})
+	}
+	return nil
+}
+
+// Encodings returns the content encodings of all compressed variants.
+func (f *CachedFile) Encodings() []string {
+	encs := make([]string, len(f.enc))
+	for i, v := range f.enc {
+		encs[i] = v.enc
+	}
+	return encs
+}
+
+// Encoded returns a compressed variant of the file or nil when no variant
+// exists for the content encoding.
+func (f *CachedFile) Encoded(enc string) *CachedFile {
+	for _, v := range f.enc {
+		if v.enc != enc {
+			continue
+		}
+		fi := *f.fi
+		fi.size = int64(len(v.buf))
+		return &CachedFile{
+			buf: v.buf,
+			rd:  bytes.NewReader(v.buf),
+			fi:  &fi,
+			sum: v.sum,
+			tag: "-" + v.enc,
+		}
+	}
+	return nil
+}
+
+// ETag returns a strong entity tag derived from the file contents. Tags of
+// compressed variants carry the content encoding as suffix.
+func (f *CachedFile) ETag() string {
+	if f.mm != nil {
+		return WeakETag(f.fi)
+	}
+	return `"` + hex.EncodeToString(f.sum[:16]) + f.tag + `"`
+}
+
+// Digest returns the SHA-256 digest of the file contents in the structured
+// field format used by the Repr-Digest header. Mapped files are not hashed.
+func (f *CachedFile) Digest() string {
+	if f.mm != nil {
+		return ""
+	}
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(f.sum[:]) + ":"
+}
+
+// WeakETag returns a weak entity tag for files that are not cached based on
+// size and modification time.
+func WeakETag(fi os.FileInfo) string {
+	return fmt.Sprintf(`W/"%x-%x"`, fi.Size(), fi.ModTime().UnixNano())
 }
 
 func IsCached(f http.File) bool {
@@ -103,16 +244,23 @@ func (f *CachedFile) Stat() (os.FileInfo, error) {
 	return f.fi, nil
 }
 
-func (f *CachedFile) ReplaceTemplates() {
+// ReplaceTemplates replaces all placeholders in the file contents with the
+// values returned by fn. Besides the placeholder text fn receives the offset
+// of the replacement in the new file contents. Text in inactive conditional
+// sections is dropped when sec is not nil.
+func (f *CachedFile) ReplaceTemplates(sec *Sections, fn func(string, int) string) {
 	buf := bytes.NewBuffer(make([]byte, 0, len(f.buf)))
-	FindAndReplace(f.buf, buf, func(v string) string {
-		s := os.Getenv(v)
-		log.Debugf("Replacing '%s' with '%s'", v, strings.Repeat("*", len(s)))
-		return s
+	var w io.Writer = buf
+	if sec != nil {
+		w = sectionWriter{w: buf, sec: sec}
+	}
+	FindAndReplace(f.buf, w, func(v string) string {
+		return fn(v, buf.Len())
 	})
 	f.buf = buf.Bytes()
 	f.rd = bytes.NewReader(f.buf)
 	f.fi.size = int64(len(f.buf))
+	f.sum = sha256.Sum256(f.buf)
 }
 
 func CheckDir(path string) error {
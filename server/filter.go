@@ -0,0 +1,165 @@
+// Copyright (c) 2019-2020 KIDTSUNAMI
+// Author: alex@kidtsunami.com
+
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/url"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// FilterFunc transforms a placeholder value.
+type FilterFunc func(val, arg string) string
+
+// escaping filters make values safe for the context they are injected into,
+// a placeholder using one of them is not escaped by default
+var escapers = map[string]FilterFunc{
+	"raw":    func(v, _ string) string { return v },
+	"html":   func(v, _ string) string { return html.EscapeString(v) },
+	"js":     func(v, _ string) string { return template.JSEscapeString(v) },
+	"json":   func(v, _ string) string { return jsonString(v) },
+	"url":    func(v, _ string) string { return url.QueryEscape(v) },
+	"base64": func(v, _ string) string { return base64.StdEncoding.EncodeToString([]byte(v)) },
+}
+
+func jsonString(v string) string {
+	// encoding/json escapes <, > and & so the result is safe inside <script>
+	buf, _ := json.Marshal(v)
+	return string(buf)
+}
+
+// modifiers control how missing values are handled, they are evaluated
+// when a value is looked up rather than applied as filter
+var modifiers = map[string]bool{
+	"default":  true, // value used when the variable is not defined
+	"required": true, // variable must be defined
+}
+
+// LookupFilter returns a filter by name.
+func LookupFilter(name string) (FilterFunc, bool) {
+	fn, ok := escapers[name]
+	return fn, ok
+}
+
+func isFilter(name string) bool {
+	_, ok := escapers[name]
+	return ok || modifiers[name]
+}
+
+// Placeholder is a parsed template placeholder of the form
+// `KEY|filter|filter:arg`.
+type Placeholder struct {
+	Key     string
+	Filters []Filter
+}
+
+// Filter is a named filter with optional argument.
+type Filter struct {
+	Name string
+	Arg  string
+}
+
+// ParsePlaceholder parses the text between template delimiters.
+func ParsePlaceholder(s string) (Placeholder, error) {
+	fields := strings.Split(s, "|")
+	p := Placeholder{Key: strings.TrimSpace(fields[0])}
+	if p.Key == "" {
+		return p, fmt.Errorf("empty placeholder name")
+	}
+	for _, v := range fields[1:] {
+		f := Filter{Name: strings.TrimSpace(v)}
+		if i := strings.Index(v, ":"); i >= 0 {
+			f.Name = strings.TrimSpace(v[:i])
+			f.Arg = v[i+1:]
+		}
+		if !isFilter(f.Name) {
+			return p, fmt.Errorf("unknown filter '%s'", f.Name)
+		}
+		p.Filters = append(p.Filters, f)
+	}
+	return p, nil
+}
+
+// String returns the placeholder text without delimiters.
+func (p Placeholder) String() string {
+	s := p.Key
+	for _, f := range p.Filters {
+		s += "|" + f.Name
+		if f.Arg != "" {
+			s += ":" + f.Arg
+		}
+	}
+	return s
+}
+
+// Default returns the default value of a placeholder, if any.
+func (p Placeholder) Default() (string, bool) {
+	for _, f := range p.Filters {
+		if f.Name == "default" {
+			return f.Arg, true
+		}
+	}
+	return "", false
+}
+
+// IsRequired returns true when the placeholder is marked as required.
+func (p Placeholder) IsRequired() bool {
+	for _, f := range p.Filters {
+		if f.Name == "required" {
+			return true
+		}
+	}
+	return false
+}
+
+// IsEscaped returns true when the placeholder uses an escaping filter.
+func (p Placeholder) IsEscaped() bool {
+	for _, f := range p.Filters {
+		if _, ok := escapers[f.Name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply runs all filters on val. When no escaping filter is used, the
+// default escaping filter is applied last.
+func (p Placeholder) Apply(val, escape string) string {
+	for _, f := range p.Filters {
+		if fn, ok := LookupFilter(f.Name); ok {
+			val = fn(val, f.Arg)
+		}
+	}
+	if !p.IsEscaped() {
+		if fn, ok := escapers[escape]; ok {
+			val = fn(val, "")
+		}
+	}
+	return val
+}
+
+// CheckEscapes makes sure default escaping modes name escaping filters.
+func CheckEscapes(m map[string]string) error {
+	for ext, v := range m {
+		if _, ok := escapers[v]; !ok {
+			return fmt.Errorf("unknown escaping mode '%s' for '%s'", v, ext)
+		}
+	}
+	return nil
+}
+
+// escapeMode returns the default escaping filter for a template file based
+// on its extension.
+func (c TemplateConfig) escapeMode(name string) string {
+	ext := strings.TrimPrefix(strings.ToLower(path.Ext(name)), ".")
+	if mode, ok := c.Escape[ext]; ok {
+		return mode
+	}
+	return "raw"
+}
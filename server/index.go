@@ -0,0 +1,206 @@
+// Copyright (c) 2019-2020 KIDTSUNAMI
+// Author: alex@kidtsunami.com
+
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/echa/log"
+)
+
+// RouteIndex is an immutable snapshot of the directory tree below the server
+// root. Request resolution uses it to decide which files exist without
+// touching the filesystem. Names are slash separated with leading slash.
+type RouteIndex struct {
+	created time.Time
+	files   map[string]bool
+	dirs    map[string]bool
+	langs   map[string][]string // directory to languages of index variants
+}
+
+// BuildRouteIndex walks root and records all files and directories as well
+// as language-prefixed variants of the index file (e.g. en-index.html).
+// Symlinked directories are walked too unless they would form a cycle.
+func BuildRouteIndex(root, index string) (*RouteIndex, error) {
+	x := &RouteIndex{
+		created: time.Now().UTC(),
+		files:   make(map[string]bool),
+		dirs:    make(map[string]bool),
+		langs:   make(map[string][]string),
+	}
+	if err := x.walk(root, "/", "-"+index, nil); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// walk records the tree below dir under name prefix. chain holds the real
+// paths of directories currently walked to detect symlink cycles.
+func (x *RouteIndex) walk(dir, prefix, suffix string, chain []string) error {
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	chain = append(chain, real)
+	return filepath.Walk(real, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			// file may have vanished since the directory was read
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		name := path.Join(prefix, relName(real, p))
+		// follow symlinks
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if fi, err = os.Stat(p); err != nil {
+				return nil
+			}
+			if fi.IsDir() {
+				x.dirs[name] = true
+				target, err := filepath.EvalSymlinks(p)
+				if err != nil || isLoop(target, chain, filepath.Dir(p)) {
+					log.Debugf("Skipping symlinked directory %s", p)
+					return nil
+				}
+				return x.walk(target, name, suffix, chain)
+			}
+		}
+		if fi.IsDir() {
+			x.dirs[name] = true
+			return nil
+		}
+		x.files[name] = true
+		if base := path.Base(name); len(base) > len(suffix) && strings.HasSuffix(base, suffix) {
+			dir := path.Dir(name)
+			x.langs[dir] = append(x.langs[dir], strings.ToLower(strings.TrimSuffix(base, suffix)))
+		}
+		return nil
+	})
+}
+
+// isLoop returns true when a symlink target contains a directory that is
+// currently walked, including the directory holding the link.
+func isLoop(target string, chain []string, parent string) bool {
+	for _, dir := range append(chain, parent) {
+		if dir == target || strings.HasPrefix(dir, target+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsFile returns true when name is a file.
+func (x *RouteIndex) IsFile(name string) bool {
+	return x.files[name]
+}
+
+// IsDir returns true when name is a directory.
+func (x *RouteIndex) IsDir(name string) bool {
+	return x.dirs[strings.TrimSuffix(name, "/")] || name == "/"
+}
+
+// Languages returns the languages for which an index variant exists in dir.
+func (x *RouteIndex) Languages(dir string) []string {
+	return x.langs[dir]
+}
+
+// filterLangs returns the accepted languages that have an index variant in
+// dir, in order of preference.
+func (x *RouteIndex) filterLangs(dir string, accepted []string) []string {
+	avail := x.langs[dir]
+	if len(avail) == 0 {
+		return nil
+	}
+	res := make([]string, 0, len(avail))
+	for _, lang := range accepted {
+		for _, v := range avail {
+			if v == lang {
+				res = append(res, lang)
+				break
+			}
+		}
+	}
+	return res
+}
+
+// Files returns the sorted names of all files.
+func (x *RouteIndex) Files() []string {
+	return sortedKeys(x.files)
+}
+
+// Dirs returns the sorted names of all directories.
+func (x *RouteIndex) Dirs() []string {
+	return sortedKeys(x.dirs)
+}
+
+func (x *RouteIndex) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Created   time.Time           `json:"created"`
+		Files     []string            `json:"files"`
+		Dirs      []string            `json:"dirs"`
+		Languages map[string][]string `json:"languages"`
+	}{
+		Created:   x.created,
+		Files:     x.Files(),
+		Dirs:      x.Dirs(),
+		Languages: x.langs,
+	})
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Snapshot returns the current route index or nil when disabled.
+func (s *SPAServer) Snapshot() *RouteIndex {
+	x, _ := s.index.Load().(*RouteIndex)
+	return x
+}
+
+// Reindex builds a new route index and replaces the current snapshot.
+func (s *SPAServer) Reindex() error {
+	x, err := BuildRouteIndex(s.cfg.Root, s.cfg.Index)
+	if err != nil {
+		return err
+	}
+	s.index.Store(x)
+	// resolutions may depend on the old snapshot
+	s.routes.Reset()
+	s.absent.Reset()
+	log.Debugf("Indexed %d files in %d directories", len(x.files), len(x.dirs))
+	return nil
+}
+
+// scheduleReindex rebuilds the route index shortly after a change. Bursts of
+// changes, like a deployment, are collapsed into a single rebuild.
+func (s *SPAServer) scheduleReindex() {
+	if s.Snapshot() == nil {
+		return
+	}
+	s.reindexMu.Lock()
+	defer s.reindexMu.Unlock()
+	if s.reindex != nil {
+		return
+	}
+	s.reindex = time.AfterFunc(100*time.Millisecond, func() {
+		s.reindexMu.Lock()
+		s.reindex = nil
+		s.reindexMu.Unlock()
+		if err := s.Reindex(); err != nil {
+			log.Errorf("Indexing server root: %v", err)
+		}
+	})
+}
@@ -0,0 +1,286 @@
+// Copyright (c) 2019-2020 KIDTSUNAMI
+// Author: alex@kidtsunami.com
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// BCP 47 language tag, restricted to what is safe to use in file names
+var langTagRegexp = regexp.MustCompile(`^[a-z]{1,8}(-[a-z0-9]{1,8})*$`)
+
+// directory names considered locales when no locale list is configured,
+// e.g. `en`, `pt-br` or `zh-hant`, but not `assets`
+var localeRegexp = regexp.MustCompile(`^[a-z]{2}(-[a-z0-9]{2,8})*$`)
+
+// ValidLang returns true when s is a well-formed lowercase language tag.
+func ValidLang(s string) bool {
+	return langTagRegexp.MatchString(s)
+}
+
+// LangRange is a language range from an Accept-Language header.
+type LangRange struct {
+	Tag string
+	Q   float64
+}
+
+// ParseAcceptLanguage returns the language ranges of an Accept-Language
+// header ordered by quality. Ranges of equal quality keep the client's order,
+// malformed ranges are skipped. Ranges without q parameter have a quality of 1.
+func ParseAcceptLanguage(h string) []LangRange {
+	var res []LangRange
+	for _, v := range strings.Split(h, ",") {
+		fields := strings.Split(v, ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		if tag != "*" && !ValidLang(tag) {
+			continue
+		}
+		q := 1.0
+		for _, p := range fields[1:] {
+			p = strings.TrimSpace(p)
+			if !strings.HasPrefix(p, "q=") {
+				continue
+			}
+			if f, err := strconv.ParseFloat(p[2:], 64); err == nil && f >= 0 && f <= 1 {
+				q = f
+			}
+		}
+		res = append(res, LangRange{Tag: tag, Q: q})
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Q > res[j].Q
+	})
+	return res
+}
+
+// NegotiateLanguage returns the language tags to try for an Accept-Language
+// header in order of preference following RFC 4647 lookup: each acceptable
+// range is followed by its truncated forms (e.g. `de-at` then `de`) and the
+// default language comes last. Tags excluded with `q=0` are never returned.
+// The wildcard range matches the default language only.
+func NegotiateLanguage(h, def string) []string {
+	ranges := ParseAcceptLanguage(h)
+	excluded := make(map[string]bool)
+	for _, r := range ranges {
+		if r.Q == 0 {
+			excluded[r.Tag] = true
+		}
+	}
+	var langs []string
+	seen := make(map[string]bool)
+	add := func(tag string) {
+		if tag != "" && !seen[tag] && !excluded[tag] {
+			seen[tag] = true
+			langs = append(langs, tag)
+		}
+	}
+	for _, r := range ranges {
+		if r.Q == 0 || r.Tag == "*" {
+			continue
+		}
+		for tag := r.Tag; tag != ""; tag = truncateLang(tag) {
+			add(tag)
+		}
+	}
+	add(def)
+	return langs
+}
+
+// truncateLang removes the last subtag of a language tag including a single
+// character subtag that precedes it (e.g. `zh-hant-x-a` becomes `zh-hant`).
+func truncateLang(tag string) string {
+	i := strings.LastIndex(tag, "-")
+	if i < 0 {
+		return ""
+	}
+	tag = tag[:i]
+	if i = strings.LastIndex(tag, "-"); i >= 0 && len(tag)-i == 2 {
+		tag = tag[:i]
+	}
+	return tag
+}
+
+// Check validates the language negotiation settings.
+func (c LangConfig) Check() error {
+	if c.Default != "" && !ValidLang(c.Default) {
+		return fmt.Errorf("invalid default language '%s'", c.Default)
+	}
+	for _, v := range c.Locales {
+		if !ValidLang(v) {
+			return fmt.Errorf("invalid locale '%s'", v)
+		}
+	}
+	if c.Prefix && (c.Redirect < 300 || c.Redirect > 399) {
+		return fmt.Errorf("invalid redirect status %d", c.Redirect)
+	}
+	return nil
+}
+
+// override returns a language set by query parameter or cookie, if any.
+func (c LangConfig) override(r *http.Request) string {
+	var lang string
+	if c.Query != "" {
+		lang = r.URL.Query().Get(c.Query)
+	}
+	if lang == "" && c.Cookie != "" {
+		if ck, err := r.Cookie(c.Cookie); err == nil {
+			lang = ck.Value
+		}
+	}
+	lang = strings.ToLower(strings.TrimSpace(lang))
+	if !ValidLang(lang) {
+		return ""
+	}
+	return lang
+}
+
+// acceptedLangs returns the languages to try for a request, a language
+// override comes first.
+func (s *SPAServer) acceptedLangs(r *http.Request) []string {
+	langs := NegotiateLanguage(r.Header.Get("Accept-Language"), s.cfg.Lang.Default)
+	if lang := s.cfg.Lang.override(r); lang != "" {
+		for i, v := range langs {
+			if v == lang {
+				langs = append(langs[:i], langs[i+1:]...)
+				break
+			}
+		}
+		langs = append([]string{lang}, langs...)
+	}
+	return langs
+}
+
+// isLocale returns true when lang is a configured locale or, without
+// locale list, looks like one.
+func (c LangConfig) isLocale(lang string) bool {
+	if len(c.Locales) == 0 {
+		return localeRegexp.MatchString(lang)
+	}
+	for _, v := range c.Locales {
+		if v == lang {
+			return true
+		}
+	}
+	return false
+}
+
+// isLocaleDir returns true when a locale directory exists for lang.
+func (s *SPAServer) isLocaleDir(lang string) bool {
+	if !s.cfg.Lang.isLocale(lang) {
+		return false
+	}
+	if x := s.Snapshot(); x != nil {
+		return x.IsDir("/" + lang)
+	}
+	f, err := s.root.Open("/" + lang)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	return err == nil && fi.IsDir()
+}
+
+// locale returns the locale prefix of a request path or an empty string.
+func (s *SPAServer) locale(name string) string {
+	if !s.cfg.Lang.Prefix {
+		return ""
+	}
+	lang := strings.SplitN(strings.TrimPrefix(name, "/"), "/", 2)[0]
+	if !s.isLocaleDir(lang) {
+		return ""
+	}
+	return lang
+}
+
+// localeRedirect returns the redirect target for a request path without
+// locale prefix. The target uses the most preferred language that has a
+// locale directory. An unknown locale prefix is replaced by the default
+// locale or, when there is no default locale directory, by the most
+// preferred one. Existing files outside locale directories, like shared
+// assets, are not redirected.
+func (s *SPAServer) localeRedirect(r *http.Request, name string) (string, bool) {
+	if !s.cfg.Lang.Prefix || s.locale(name) != "" {
+		return "", false
+	}
+	if f, _ := s.probe(name); f != nil {
+		f.Close()
+		return "", false
+	}
+	var langs []string
+	parts := strings.SplitN(strings.TrimPrefix(name, "/"), "/", 2)
+	if s.cfg.Lang.isLocale(parts[0]) {
+		name = "/"
+		if len(parts) > 1 {
+			name += parts[1]
+		}
+		if def := s.cfg.Lang.Default; def != "" && s.isLocaleDir(def) {
+			langs = []string{def}
+		}
+	}
+	if langs == nil {
+		langs = s.acceptedLangs(r)
+	}
+	for _, lang := range langs {
+		if !s.isLocaleDir(lang) {
+			continue
+		}
+		target := normalizeBase(s.cfg.Base) + "/" + lang + name
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		return target, true
+	}
+	return "", false
+}
+
+// hasLangPatterns returns true when request resolution depends on language.
+func (s *SPAServer) hasLangPatterns() bool {
+	for _, p := range s.cfg.TryFiles {
+		if p.Lang {
+			return true
+		}
+	}
+	return false
+}
+
+// fileLang returns the language of a language-specific index file.
+func (s *SPAServer) fileLang(name string) string {
+	suffix := "-" + s.cfg.Index
+	if base := path.Base(name); len(base) > len(suffix) && strings.HasSuffix(base, suffix) {
+		return strings.ToLower(strings.TrimSuffix(base, suffix))
+	}
+	return ""
+}
+
+// setVaryLang marks a response as depending on the accepted languages.
+func (s *SPAServer) setVaryLang(h http.Header) {
+	addVary(h, "Accept-Language")
+	if s.cfg.Lang.Cookie != "" {
+		addVary(h, "Cookie")
+	}
+}
+
+// setLangHeaders marks responses whose file was selected by language
+// negotiation as varying and announces the language of language-specific
+// files and locale directories.
+func (s *SPAServer) setLangHeaders(w http.ResponseWriter, reqname, name string) {
+	h := w.Header()
+	if name != reqname && s.hasLangPatterns() {
+		s.setVaryLang(h)
+	}
+	lang := s.fileLang(name)
+	if lang == "" {
+		lang = s.locale(name)
+	}
+	if lang != "" {
+		h.Set("Content-Language", lang)
+	}
+}
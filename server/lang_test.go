@@ -0,0 +1,63 @@
+// Copyright (c) 2019-2020 KIDTSUNAMI
+// Author: alex@kidtsunami.com
+
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseAcceptLanguage(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []LangRange
+	}{
+		{"", nil},
+		{"de", []LangRange{{"de", 1}}},
+		{"de-AT, en;q=0.8, *;q=0.1", []LangRange{{"de-at", 1}, {"en", 0.8}, {"*", 0.1}}},
+		{"en;q=0.5,de;q=0.5,fr", []LangRange{{"fr", 1}, {"en", 0.5}, {"de", 0.5}}},
+		{"de;q=0", []LangRange{{"de", 0}}},
+		{"de;q=2, en;q=x", []LangRange{{"de", 1}, {"en", 1}}},
+		{"en_US, de/x, fr", []LangRange{{"fr", 1}}},
+	}
+	for _, tt := range tests {
+		if got := ParseAcceptLanguage(tt.header); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseAcceptLanguage(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestNegotiateLanguage(t *testing.T) {
+	tests := []struct {
+		header string
+		def    string
+		want   []string
+	}{
+		{"", "", nil},
+		{"", "en", []string{"en"}},
+		{"de", "en", []string{"de", "en"}},
+		{"en", "en", []string{"en"}},
+		// truncation
+		{"de-AT", "", []string{"de-at", "de"}},
+		{"zh-Hant-TW", "en", []string{"zh-hant-tw", "zh-hant", "zh", "en"}},
+		{"zh-hant-x-a", "", []string{"zh-hant-x-a", "zh-hant", "zh"}},
+		{"de-at,de-ch", "", []string{"de-at", "de", "de-ch"}},
+		{"de-at,fr,de", "", []string{"de-at", "de", "fr"}},
+		// q-values
+		{"fr;q=0.5,de", "en", []string{"de", "fr", "en"}},
+		{"de,en;q=0", "en", []string{"de"}},
+		{"de-at,de;q=0", "", []string{"de-at"}},
+		{"de;q=0,de-at", "", []string{"de-at"}},
+		{"de;q=0", "", nil},
+		// wildcard
+		{"*", "fr", []string{"fr"}},
+		{"*", "", nil},
+		{"de,*;q=0.5", "en", []string{"de", "en"}},
+	}
+	for _, tt := range tests {
+		if got := NegotiateLanguage(tt.header, tt.def); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("NegotiateLanguage(%q, %q) = %v, want %v", tt.header, tt.def, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+// Copyright (c) 2019-2020 KIDTSUNAMI
+// Author: alex@kidtsunami.com
+
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package server
+
+import (
+	"errors"
+	"os"
+)
+
+type mmapData struct {
+	buf []byte
+}
+
+func mmapFile(f *os.File, size int64) (*mmapData, error) {
+	return nil, errors.New("mmap not supported on this platform")
+}
@@ -0,0 +1,35 @@
+// Copyright (c) 2019-2020 KIDTSUNAMI
+// Author: alex@kidtsunami.com
+
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package server
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// mmapData owns a read-only memory mapping. The mapping is released by a
+// finalizer once the last cached file referencing it has been collected, so
+// evicting a file from cache never invalidates a response in flight.
+type mmapData struct {
+	buf []byte
+}
+
+func mmapFile(f *os.File, size int64) (*mmapData, error) {
+	buf, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, os.NewSyscallError("mmap", err)
+	}
+	m := &mmapData{buf: buf}
+	runtime.SetFinalizer(m, (*mmapData).unmap)
+	return m, nil
+}
+
+func (m *mmapData) unmap() {
+	syscall.Munmap(m.buf)
+	m.buf = nil
+}
@@ -0,0 +1,195 @@
+// Copyright (c) 2019-2020 KIDTSUNAMI
+// Author: alex@kidtsunami.com
+
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/echa/config"
+	"github.com/echa/log"
+)
+
+// MountConfig describes an additional app served below its own base path.
+// Empty fields inherit the main server settings.
+type MountConfig struct {
+	Base    string
+	Root    string
+	Index   string
+	Match   string            // template match regexp
+	Rules   []CacheRule       // nil inherits the main cache rules
+	Headers map[string]string // nil inherits the main extra headers
+}
+
+// ParseMounts reads the `mounts` config list. Mount base paths must be unique
+// and differ from the main server base path.
+func ParseMounts() ([]MountConfig, error) {
+	if !hasConfig("mounts") {
+		return nil, nil
+	}
+	var mounts []MountConfig
+	bases := map[string]bool{
+		normalizeBase(config.GetString("server.base")): true,
+	}
+	err := config.ForEach("mounts", func(c *config.Config) error {
+		m := MountConfig{
+			Base:  normalizeBase(c.GetString("base")),
+			Root:  c.GetString("root"),
+			Index: c.GetString("index"),
+			Match: c.GetString("template.match"),
+		}
+		if m.Base == "" {
+			return fmt.Errorf("mount %d: missing base path", len(mounts))
+		}
+		if bases[m.Base] {
+			return fmt.Errorf("mount %s: duplicate base path", m.Base)
+		}
+		bases[m.Base] = true
+		if m.Root == "" {
+			return fmt.Errorf("mount %s: missing root directory", m.Base)
+		}
+		settings := c.AllSettings()
+		if hasPath(settings, "cache.rules") {
+			rules, err := parseCacheRules(c.ForEach, "cache.rules")
+			if err != nil {
+				return fmt.Errorf("mount %s: cannot read cache config: %v", m.Base, err)
+			}
+			// an empty list disables the main rules
+			m.Rules = append([]CacheRule{}, rules...)
+		}
+		if hasPath(settings, "headers") {
+			m.Headers = c.GetStringMap("headers")
+		}
+		mounts = append(mounts, m)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mounts, nil
+}
+
+// normalizeBase returns a base path with leading and without trailing slash
+// or an empty string for the root path.
+func normalizeBase(base string) string {
+	if base == "" {
+		return ""
+	}
+	return strings.TrimSuffix(cleanPath(base), "/")
+}
+
+// Mux dispatches requests to the main server and additional mounts by
+// longest base path prefix. All servers share the listener.
+type Mux struct {
+	main    *SPAServer
+	servers []*SPAServer // ordered by base path length, longest first
+}
+
+// LoadMux creates the main server and all mounts from config for inspecting
+// templates. Servers are not started and cannot serve requests.
+func LoadMux() (*Mux, error) {
+	return newMux(loadSPAServer)
+}
+
+// NewMux creates the main server and all mounts from config and starts them
+// like NewSPAServer.
+func NewMux() (*Mux, error) {
+	return newMux(newSPAServer)
+}
+
+func newMux(fn func(*MountConfig) (*SPAServer, error)) (*Mux, error) {
+	mounts, err := ParseMounts()
+	if err != nil {
+		return nil, err
+	}
+	main, err := fn(nil)
+	if err != nil {
+		return nil, err
+	}
+	mux := &Mux{
+		main:    main,
+		servers: []*SPAServer{main},
+	}
+	for i := range mounts {
+		srv, err := fn(&mounts[i])
+		if err != nil {
+			mux.Close()
+			return nil, fmt.Errorf("mount %s: %v", mounts[i].Base, err)
+		}
+		log.Infof("Mounted directory %s at %s", srv.cfg.Root, srv.cfg.Base)
+		mux.servers = append(mux.servers, srv)
+	}
+	sort.SliceStable(mux.servers, func(i, j int) bool {
+		return len(mux.servers[i].cfg.Base) > len(mux.servers[j].cfg.Base)
+	})
+	return mux, nil
+}
+
+// Main returns the main server.
+func (m *Mux) Main() *SPAServer {
+	return m.main
+}
+
+// Servers returns the main server and all mounts, longest base path first.
+func (m *Mux) Servers() []*SPAServer {
+	return m.servers
+}
+
+// Lookup returns the server with the longest base path matching a request
+// path. Paths outside all base paths belong to the main server.
+func (m *Mux) Lookup(p string) *SPAServer {
+	p = cleanPath(p)
+	for _, s := range m.servers {
+		if base := normalizeBase(s.cfg.Base); base == "" || isBelow(p, base) {
+			return s
+		}
+	}
+	return m.main
+}
+
+// Mount returns the server for a file name and the name relative to its
+// root. Names below the base path of a mount belong to the mount, all others
+// to the main server.
+func (m *Mux) Mount(name string) (*SPAServer, string) {
+	if s := m.Lookup(name); s != m.main {
+		return s, cleanPath(strings.TrimPrefix(cleanPath(name), normalizeBase(s.cfg.Base)))
+	}
+	return m.main, name
+}
+
+func (m *Mux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.Lookup(r.URL.Path).ServeHTTP(w, r)
+}
+
+// Reload reloads template values of all servers.
+func (m *Mux) Reload() error {
+	for _, s := range m.servers {
+		if err := s.Reload(); err != nil {
+			return fmt.Errorf("%s: %v", s.cfg.Root, err)
+		}
+	}
+	return nil
+}
+
+// Close stops background tasks of all servers.
+func (m *Mux) Close() error {
+	var err error
+	for _, s := range m.servers {
+		if e := s.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (m *Mux) Address() string {
+	return m.main.Address()
+}
+
+func (m *Mux) TLS() *tls.Config {
+	return m.main.TLS()
+}
@@ -75,6 +75,192 @@ func ReplaceTemplates(src []byte, w io.Writer, locs []int, fn func(string) strin
 	w.Write(src[last:])
 }
 
+// TemplateMatch is a placeholder found by ScanTemplates.
+type TemplateMatch struct {
+	Start int    // offset of the start delimiter
+	End   int    // offset of the end delimiter, -1 when unterminated
+	Line  int    // line of the start delimiter, starting at 1
+	Text  string // text between delimiters, truncated when too long
+}
+
+// IsOversize returns true when the placeholder exceeds the max replace size.
+func (m TemplateMatch) IsOversize() bool {
+	return m.End >= 0 && m.End-m.Start > maxReplace
+}
+
+// IsUnterminated returns true when the placeholder has no end delimiter.
+func (m TemplateMatch) IsUnterminated() bool {
+	return m.End < 0
+}
+
+// ScanTemplates returns all placeholders in buf including those FindTemplates
+// skips because they are too long or not terminated.
+func ScanTemplates(buf []byte) []TemplateMatch {
+	var (
+		res  []TemplateMatch
+		line = 1
+		last int
+	)
+	text := func(b []byte) string {
+		if len(b) > maxReplace {
+			b = b[:maxReplace]
+		}
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			b = b[:i]
+		}
+		return string(b)
+	}
+	for i := 0; i < len(buf); {
+		found := bytes.Index(buf[i:], startDelim)
+		if found < 0 {
+			break
+		}
+		start := i + found
+		line += bytes.Count(buf[last:start], []byte("\n"))
+		last = start
+		body := start + len(startDelim)
+		m := TemplateMatch{Start: start, End: -1, Line: line}
+		found = bytes.Index(buf[body:], endDelim)
+		if found < 0 {
+			m.Text = text(buf[body:])
+			res = append(res, m)
+			break
+		}
+		m.End = body + found
+		m.Text = text(buf[body:m.End])
+		res = append(res, m)
+		if m.IsOversize() {
+			// like FindTemplates continue scanning inside the skipped text
+			i = body
+		} else {
+			i = m.End + len(endDelim)
+		}
+	}
+	return res
+}
+
+// FindPlaceholders returns the text between delimiters of all placeholders.
+func FindPlaceholders(buf []byte) []string {
+	locs := FindTemplates(buf)
+	res := make([]string, 0, len(locs)/2)
+	for i := 0; i < len(locs); i += 2 {
+		res = append(res, string(buf[locs[i]+len(startDelim):locs[i+1]]))
+	}
+	return res
+}
+
 func FindAndReplace(buf []byte, w io.Writer, fn func(string) string) {
 	ReplaceTemplates(buf, w, FindTemplates(buf), fn)
 }
+
+// TemplateReader replaces placeholders while reading from an underlying
+// reader, so large files can be template-replaced without loading them into
+// memory. Placeholders may span read boundaries. At most maxReplace bytes
+// beyond a chunk are buffered while looking for an end delimiter. Text in
+// inactive conditional sections is dropped when sec is not nil.
+type TemplateReader struct {
+	r   io.Reader
+	sec *Sections
+	fn  func(string) string
+	buf []byte // read buffer
+	in  []byte // unprocessed input
+	out []byte // processed output
+	pos int    // read position in out
+	err error  // sticky read error
+}
+
+func NewTemplateReader(r io.Reader, sec *Sections, fn func(string) string) *TemplateReader {
+	return &TemplateReader{
+		r:   r,
+		sec: sec,
+		fn:  fn,
+		buf: make([]byte, 32*1024),
+	}
+}
+
+func (t *TemplateReader) Read(p []byte) (int, error) {
+	for t.pos == len(t.out) {
+		t.out, t.pos = t.out[:0], 0
+		if t.err != nil {
+			if len(t.in) == 0 {
+				return 0, t.err
+			}
+		} else {
+			n, err := t.r.Read(t.buf)
+			t.in = append(t.in, t.buf[:n]...)
+			t.err = err
+		}
+		t.process()
+	}
+	n := copy(p, t.out[t.pos:])
+	t.pos += n
+	return n, nil
+}
+
+// process moves input to output, replacing complete placeholders. Input that
+// may belong to a placeholder is kept until more data arrives or the
+// underlying reader is exhausted.
+func (t *TemplateReader) process() {
+	var (
+		eof  = t.err != nil
+		in   = t.in
+		keep int
+	)
+	for len(in) > 0 {
+		start := bytes.Index(in, startDelim)
+		if start < 0 {
+			// keep a trailing partial start delimiter
+			if !eof {
+				keep = min(len(in), len(startDelim)-1)
+			}
+			t.emit(in[:len(in)-keep])
+			in = in[len(in)-keep:]
+			break
+		}
+		t.emit(in[:start])
+		in = in[start:]
+		found := bytes.Index(in[len(startDelim):], endDelim)
+		if found < 0 {
+			if eof {
+				// unterminated, send as is
+				t.emit(in)
+				in = in[:0]
+				break
+			}
+			if len(in)-len(endDelim)+1 <= maxReplace {
+				// wait for more data
+				break
+			}
+			// any end delimiter would be too far away, skip like FindTemplates
+			t.emit(in[:1])
+			in = in[1:]
+			continue
+		}
+		end := found + len(startDelim)
+		if end > maxReplace {
+			log.Warnf("Skipping %d byte template string '%s'", end, in[:maxReplace])
+			t.emit(in[:1])
+			in = in[1:]
+			continue
+		}
+		t.out = append(t.out, t.fn(string(in[len(startDelim):end]))...)
+		in = in[end+len(endDelim):]
+	}
+	// move remaining input to the front to reuse the buffer
+	t.in = t.in[:copy(t.in, in)]
+}
+
+// emit appends literal text to the output unless it is in an inactive
+// conditional section.
+func (t *TemplateReader) emit(b []byte) {
+	if t.sec == nil || t.sec.Active() {
+		t.out = append(t.out, b...)
+	}
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
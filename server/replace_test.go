@@ -0,0 +1,75 @@
+// Copyright (c) 2019-2020 KIDTSUNAMI
+// Author: alex@kidtsunami.com
+
+package server
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// chunkReader returns at most n bytes per read to split input at arbitrary
+// positions.
+type chunkReader struct {
+	b []byte
+	n int
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.b) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.b[:min(r.n, len(r.b))])
+	r.b = r.b[n:]
+	return n, nil
+}
+
+func testReplace(v string) string {
+	return "<" + strings.ToLower(v) + ">"
+}
+
+func TestTemplateReader(t *testing.T) {
+	long := strings.Repeat("x", maxReplace)
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"empty", "", ""},
+		{"plain", "no placeholders", "no placeholders"},
+		{"single", "a [[A]] b", "a <a> b"},
+		{"adjacent", "[[A]][[B]]", "<a><b>"},
+		{"empty placeholder", "a [[]] b", "a <> b"},
+		{"extra bracket", "[[[A]]", "<[a>"},
+		{"partial start", "a [ b [", "a [ b ["},
+		{"lone end", "a ]] b", "a ]] b"},
+		{"oversize", "a [[" + long + "]] b", "a [[" + long + "]] b"},
+		{"oversize with placeholder", "[[" + long + "[[A]] b", "[[" + long + "<a> b"},
+		{"unterminated", "a [[A", "a [[A"},
+		{"unterminated after placeholder", "[[A]] [[B", "<a> [[B"},
+		{"multiline", "a\n[[A]]\nb [[B]]", "a\n<a>\nb <b>"},
+	}
+	for _, tt := range tests {
+		// reference result from the in-memory implementation
+		var ref bytes.Buffer
+		FindAndReplace([]byte(tt.in), &ref, testReplace)
+		if ref.String() != tt.want {
+			t.Errorf("%s: FindAndReplace = %q, want %q", tt.name, ref.String(), tt.want)
+		}
+		// split input at every possible position
+		for n := 1; n <= len(tt.in)+1; n++ {
+			rd := NewTemplateReader(&chunkReader{b: []byte(tt.in), n: n}, nil, testReplace)
+			got, err := ioutil.ReadAll(rd)
+			if err != nil {
+				t.Errorf("%s: chunk size %d: unexpected error %v", tt.name, n, err)
+				continue
+			}
+			if string(got) != tt.want {
+				t.Errorf("%s: chunk size %d: got %q, want %q", tt.name, n, got, tt.want)
+			}
+		}
+	}
+}
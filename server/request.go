@@ -0,0 +1,186 @@
+// Copyright (c) 2019-2020 KIDTSUNAMI
+// Author: alex@kidtsunami.com
+
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/echa/log"
+)
+
+// source prefix of request-specific template variables which are rendered on
+// every request rather than once when a file is cached
+const requestPrefix = "request"
+
+// names of request-specific template variables
+var requestKeys = map[string]bool{
+	"id":    true, // request id, also sent as X-Request-Id header
+	"host":  true, // requested host name
+	"lang":  true, // language of the response
+	"base":  true, // base path the app is served from
+	"nonce": true, // random CSP nonce, unique per request
+}
+
+// isRequestKey returns true when a template variable is request-specific.
+func isRequestKey(key string) bool {
+	prefix, _ := SplitKey(key)
+	return prefix == requestPrefix
+}
+
+// checkRequestKey fails when a request-specific variable is unknown.
+func checkRequestKey(key string) error {
+	_, name := SplitKey(key)
+	if !requestKeys[name] {
+		return fmt.Errorf("unknown request variable '%s'", name)
+	}
+	return nil
+}
+
+// RequestValues resolves request-specific template variables. The CSP nonce
+// is generated on first use so requests that don't need it don't pay for it.
+type RequestValues struct {
+	ID    string
+	Host  string
+	Lang  string
+	Base  string
+	nonce string
+}
+
+func (s *SPAServer) newRequestValues(r *http.Request) *RequestValues {
+	rid := r.Header.Get("X-Request-Id")
+	if rid == "" {
+		rid = "SV-" + <-idStream
+	}
+	return &RequestValues{
+		ID:   rid,
+		Host: r.Host,
+		Base: s.cfg.Base,
+	}
+}
+
+// Nonce returns a base64 encoded 128 bit random value.
+func (v *RequestValues) Nonce() string {
+	if v.nonce == "" {
+		var b [16]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			log.Errorf("Generating CSP nonce: %v", err)
+		}
+		v.nonce = base64.StdEncoding.EncodeToString(b[:])
+	}
+	return v.nonce
+}
+
+func (v *RequestValues) Lookup(key string) (string, bool) {
+	_, key = SplitKey(key)
+	switch key {
+	case "id":
+		return v.ID, true
+	case "host":
+		return v.Host, true
+	case "lang":
+		return v.Lang, true
+	case "base":
+		return v.Base, true
+	case "nonce":
+		return v.Nonce(), true
+	default:
+		return "", false
+	}
+}
+
+// Expand replaces request-specific placeholders in s, other placeholders are
+// left unchanged. Values are not escaped unless a placeholder uses an
+// escaping filter.
+func (v *RequestValues) Expand(s string) string {
+	if !strings.Contains(s, string(startDelim)) {
+		return s
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, len(s)))
+	FindAndReplace([]byte(s), buf, func(t string) string {
+		p, err := ParsePlaceholder(t)
+		if err != nil || !isRequestKey(p.Key) {
+			return string(startDelim) + t + string(endDelim)
+		}
+		val, _ := v.Lookup(p.Key)
+		return p.Apply(val, "raw")
+	})
+	return buf.String()
+}
+
+// requestLang returns the language of a response, which is the language of
+// a language-specific index file or locale directory or the client's
+// preferred language.
+func (s *SPAServer) requestLang(r *http.Request, name string) string {
+	if lang := s.fileLang(name); lang != "" {
+		return lang
+	}
+	if lang := s.locale(name); lang != "" {
+		return lang
+	}
+	if langs := s.acceptedLangs(r); len(langs) > 0 {
+		return langs[0]
+	}
+	return ""
+}
+
+// CheckHeaders makes sure request-specific placeholders in extra response
+// headers use known variables.
+func CheckHeaders(headers map[string]string) error {
+	for n, v := range headers {
+		for _, t := range FindPlaceholders([]byte(v)) {
+			p, err := ParsePlaceholder(t)
+			if err == nil && isRequestKey(p.Key) {
+				err = checkRequestKey(p.Key)
+			}
+			if err != nil {
+				return fmt.Errorf("header %s: placeholder '%s': %v", n, t, err)
+			}
+		}
+	}
+	return nil
+}
+
+// requestTemplate records where request-specific placeholders were removed
+// from a cached file so they can be rendered per request without scanning
+// the file again.
+type requestTemplate struct {
+	offs   []int // offsets into the cached file contents
+	vars   []Placeholder
+	escape string
+}
+
+func (t *requestTemplate) add(off int, p Placeholder) {
+	t.offs = append(t.offs, off)
+	t.vars = append(t.vars, p)
+}
+
+// Render returns a copy of f with request-specific placeholders replaced or f
+// when it contains none.
+func (f *CachedFile) Render(v *RequestValues) *CachedFile {
+	t := f.tpl
+	if t == nil {
+		return f
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, len(f.buf)+len(t.offs)*32))
+	last := 0
+	for i, off := range t.offs {
+		buf.Write(f.buf[last:off])
+		val, _ := v.Lookup(t.vars[i].Key)
+		buf.WriteString(t.vars[i].Apply(val, t.escape))
+		last = off
+	}
+	buf.Write(f.buf[last:])
+	fi := *f.fi
+	fi.size = int64(buf.Len())
+	return &CachedFile{
+		buf: buf.Bytes(),
+		rd:  bytes.NewReader(buf.Bytes()),
+		fi:  &fi,
+	}
+}
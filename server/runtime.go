@@ -0,0 +1,143 @@
+// Copyright (c) 2019-2020 KIDTSUNAMI
+// Author: alex@kidtsunami.com
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/echa/log"
+)
+
+// JS global variable name, may be a dotted path like `window.app.env`
+var jsIdentRegexp = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*(\.[A-Za-z_$][A-Za-z0-9_$]*)*$`)
+
+// NewRuntimeConfig generates the contents of a virtual runtime config file
+// from environment variables matching one of the configured prefixes and an
+// optional JSON or YAML value file. Environment variables take precedence
+// over top-level keys of the value file. Files with `.js` extension assign
+// the config to a global variable, all others contain plain JSON.
+func (s *SPAServer) NewRuntimeConfig() (*CachedFile, error) {
+	c := s.cfg.Runtime
+	data := make(map[string]interface{})
+	if c.File != "" {
+		v, err := readValueFile(c.File)
+		if err != nil {
+			return nil, err
+		}
+		m, ok := normalize(v).(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("value file %s: top-level value must be an object", c.File)
+		}
+		data = m
+	}
+	for _, kv := range os.Environ() {
+		kv := strings.SplitN(kv, "=", 2)
+		key, ok := c.match(kv[0])
+		if !ok {
+			continue
+		}
+		if !s.cfg.Tpl.IsAllowed(kv[0]) {
+			log.Debugf("Skipping runtime config variable %s: not allowed", kv[0])
+			continue
+		}
+		data[key] = kv[1]
+	}
+	// encoding/json escapes <, > and & so the result is safe inside <script>
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	if strings.ToLower(path.Ext(c.Path)) == ".js" {
+		var b bytes.Buffer
+		if !strings.Contains(c.Var, ".") {
+			b.WriteString("window.")
+		}
+		b.WriteString(c.Var)
+		b.WriteString(" = ")
+		b.Write(buf)
+		b.WriteString(";\n")
+		buf = b.Bytes()
+	}
+	log.Debugf("Generated runtime config %s with %d keys", c.Path, len(data))
+	return NewCachedBuffer(path.Base(c.Path), buf)
+}
+
+// runtimeConfig returns the generated runtime config file or nil when
+// disabled.
+func (s *SPAServer) runtimeConfig() *CachedFile {
+	f, _ := s.runtime.Load().(*CachedFile)
+	return f
+}
+
+// loadRuntimeConfig generates the runtime config file and adds compressed
+// variants when enabled.
+func (s *SPAServer) loadRuntimeConfig() (*CachedFile, error) {
+	f, err := s.NewRuntimeConfig()
+	if err != nil {
+		return nil, err
+	}
+	if s.useCompression(s.cfg.Runtime.Path, f.fi.size) {
+		if err := f.Compress(s.cfg.Compress.Encodings); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// match returns the config key for an environment variable and whether the
+// variable matches any prefix.
+func (c RuntimeConfig) match(name string) (string, bool) {
+	for _, p := range c.Prefix {
+		if p == "" || !strings.HasPrefix(name, p) {
+			continue
+		}
+		if c.StripPrefix {
+			return strings.TrimPrefix(name, p), true
+		}
+		return name, true
+	}
+	return "", false
+}
+
+// Check validates the runtime config file settings.
+func (c RuntimeConfig) Check() error {
+	if !strings.HasPrefix(c.Path, "/") || cleanPath(c.Path) != c.Path || strings.HasSuffix(c.Path, "/") {
+		return fmt.Errorf("invalid path '%s'", c.Path)
+	}
+	if strings.ToLower(path.Ext(c.Path)) == ".js" && !jsIdentRegexp.MatchString(c.Var) {
+		return fmt.Errorf("invalid variable name '%s'", c.Var)
+	}
+	return nil
+}
+
+// normalize converts maps decoded from YAML into maps with string keys so
+// they can be encoded as JSON.
+func normalize(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(val))
+		for k, v := range val {
+			m[fmt.Sprint(k)] = normalize(v)
+		}
+		return m
+	case map[string]interface{}:
+		for k, v := range val {
+			val[k] = normalize(v)
+		}
+		return val
+	case []interface{}:
+		for i, v := range val {
+			val[i] = normalize(v)
+		}
+		return val
+	default:
+		return v
+	}
+}
@@ -14,9 +14,12 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"path"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/echa/config"
@@ -31,14 +34,58 @@ func init() {
 	config.SetDefault("server.port", 8000)
 	config.SetDefault("server.root", ".")
 	config.SetDefault("server.index", "index.html")
+	config.SetDefault("server.try_files", defaultTryFiles)
+	config.SetDefault("lang.default", "")
+	config.SetDefault("lang.cookie", "")
+	config.SetDefault("lang.query", "")
+	config.SetDefault("lang.prefix", false)
+	config.SetDefault("lang.locales", []string{})
+	config.SetDefault("lang.redirect", http.StatusFound)
 	config.SetDefault("template.enable", true)
 	config.SetDefault("template.left", "<[") // may use {{}}, [[]], <%%> <##>, <<>>
 	config.SetDefault("template.right", "]>")
-	config.SetDefault("template.maxreplace", 32)
+	config.SetDefault("template.maxreplace", 128)
 	config.SetDefault("template.maxsize", int64(16*1024*1024))
+	config.SetDefault("template.allow", []string{})
+	config.SetDefault("template.deny", []string{"SV_"})
+	config.SetDefault("template.keep_denied", false)
+	config.SetDefault("template.strict", false)
+	config.SetDefault("template.escape", map[string]interface{}{})
+	config.SetDefault("compress.precompressed", []string{})
+	config.SetDefault("compress.enable", false)
+	config.SetDefault("compress.encodings", []string{"br", "gzip"})
+	config.SetDefault("compress.minsize", 1024)
+	config.SetDefault("compress.types", []string{
+		"text/html",
+		"text/css",
+		"text/plain",
+		"text/csv",
+		"application/javascript",
+		"application/json",
+		"application/xml",
+		"image/svg+xml",
+	})
+	config.SetDefault("runtime.enable", false)
+	config.SetDefault("runtime.path", "/env.js")
+	config.SetDefault("runtime.var", "__ENV__")
+	config.SetDefault("runtime.prefix", []string{})
+	config.SetDefault("runtime.strip_prefix", false)
+	config.SetDefault("runtime.file", "")
 	config.SetDefault("cache.enable", true)
 	config.SetDefault("cache.expires", 30*time.Second)
 	config.SetDefault("cache.control", "public")
+	config.SetDefault("cache.maxsize", int64(16*1024*1024))
+	config.SetDefault("cache.maxmem", int64(128*1024*1024))
+	config.SetDefault("cache.maxfiles", 0)
+	config.SetDefault("cache.maxroutes", 10000)
+	config.SetDefault("cache.index", false)
+	config.SetDefault("cache.mmap", false)
+	config.SetDefault("cache.mmap_maxmem", int64(1024*1024*1024))
+	config.SetDefault("cache.etag", true)
+	config.SetDefault("cache.digest", false)
+	config.SetDefault("cache.watch", false)
+	config.SetDefault("cache.poll", false)
+	config.SetDefault("cache.poll_interval", 2*time.Second)
 
 	// start async ID generator
 	idStream = make(chan string, 100)
@@ -53,32 +100,79 @@ func init() {
 }
 
 type ServerConfig struct {
-	Addr   string
-	Port   int
-	Scheme string
-	Host   string
-	Root   string
-	Base   string
-	Index  string
-	CspLog string
-	Cache  CacheConfig
-	Tpl    TemplateConfig
+	Addr     string
+	Port     int
+	Scheme   string
+	Host     string
+	Root     string
+	Base     string
+	Index    string
+	TryFiles []TryPattern
+	CspLog   string
+	Routes   string
+	Cache    CacheConfig
+	Tpl      TemplateConfig
+	Compress CompressConfig
+	Runtime  RuntimeConfig
+	Lang     LangConfig
 }
 
 type CacheConfig struct {
-	Enable  bool
-	Expires time.Duration
-	Control string
-	Rules   []CacheRule
+	Enable       bool
+	Expires      time.Duration
+	Control      string
+	MaxSize      int64
+	MaxMem       int64
+	MaxFiles     int
+	MaxRoutes    int
+	Index        bool
+	Mmap         bool
+	MmapMaxMem   int64
+	ETag         bool
+	Digest       bool
+	Watch        bool
+	Poll         bool
+	Interval     time.Duration
+	Warmup       *regexp.Regexp
+	WarmupStrict bool
+	Rules        []CacheRule
 }
 
 type CacheRule struct {
-	Filename string
-	Regexp   *regexp.Regexp
-	Ignore   bool
-	NoCache  bool
-	Expires  time.Duration
-	Control  string
+	Filename   string
+	Regexp     *regexp.Regexp
+	Ignore     bool
+	NoCache    bool
+	Expires    time.Duration
+	Control    string
+	Pin        bool // keep in memory cache, never evict
+	NoMemCache bool // never keep in memory cache
+}
+
+type CompressConfig struct {
+	Precompressed []string
+	Enable        bool
+	Encodings     []string
+	MinSize       int64
+	Types         []string
+}
+
+type RuntimeConfig struct {
+	Enable      bool
+	Path        string   // virtual file name, `.js` assigns a global variable
+	Var         string   // global JS variable name
+	Prefix      []string // environment variable prefixes
+	StripPrefix bool
+	File        string // JSON or YAML value file
+}
+
+type LangConfig struct {
+	Default  string   // language used when no accepted language is available
+	Cookie   string   // name of a cookie that overrides the accepted languages
+	Query    string   // name of a query parameter that overrides the accepted languages
+	Prefix   bool     // route requests to locale directories like /en/
+	Locales  []string // names of locale directories
+	Redirect int      // status of redirects to locale directories
 }
 
 type TemplateConfig struct {
@@ -88,16 +182,37 @@ type TemplateConfig struct {
 	Right      string
 	MaxSize    int64
 	MaxReplace int
+	Allow      []*regexp.Regexp
+	Deny       []*regexp.Regexp
+	KeepDenied bool
+	Strict     bool
+	Escape     map[string]string // file extension to default escaping filter
 }
 
 type SPAServer struct {
 	cfg     ServerConfig
 	headers map[string]string
 	root    http.FileSystem
-	cache   map[string]http.File
+	cache   *FileCache
+	mmaps   *FileCache
+	routes  *ResolveCache
+	absent  *ResolveCache // precompressed siblings known not to exist
+	values  atomic.Value  // *Values
+	conf    atomic.Value  // *expandedConfig
+	runtime atomic.Value  // *CachedFile, generated runtime config file
+	index   atomic.Value  // *RouteIndex
+	watcher io.Closer
+
+	reindexMu sync.Mutex
+	reindex   *time.Timer
 }
 
-func NewSPAServer() (*SPAServer, error) {
+// loadSPAServer creates the main server or, when m is not nil, a server for
+// an additional mount that overrides some of the main server settings. It
+// does not start background tasks, validate templates or replace
+// placeholders in headers and cache rules, so command line tools can use it
+// to inspect templates.
+func loadSPAServer(m *MountConfig) (*SPAServer, error) {
 	srv := &SPAServer{
 		cfg: ServerConfig{
 			Addr:   config.GetString("server.addr"),
@@ -108,10 +223,24 @@ func NewSPAServer() (*SPAServer, error) {
 			Index:  config.GetString("server.index"),
 			Base:   config.GetString("server.base"),
 			CspLog: config.GetString("server.csplog"),
+			Routes: config.GetString("server.routes"),
 			Cache: CacheConfig{
-				Enable:  config.GetBool("cache.enable"),
-				Expires: config.GetDuration("cache.expires"),
-				Control: config.GetString("cache.control"),
+				Enable:       config.GetBool("cache.enable"),
+				Expires:      config.GetDuration("cache.expires"),
+				Control:      config.GetString("cache.control"),
+				MaxSize:      config.GetInt64("cache.maxsize"),
+				MaxMem:       config.GetInt64("cache.maxmem"),
+				MaxFiles:     config.GetInt("cache.maxfiles"),
+				MaxRoutes:    config.GetInt("cache.maxroutes"),
+				Index:        config.GetBool("cache.index"),
+				Mmap:         config.GetBool("cache.mmap"),
+				MmapMaxMem:   config.GetInt64("cache.mmap_maxmem"),
+				ETag:         config.GetBool("cache.etag"),
+				Digest:       config.GetBool("cache.digest"),
+				Watch:        config.GetBool("cache.watch"),
+				Poll:         config.GetBool("cache.poll"),
+				Interval:     config.GetDuration("cache.poll_interval"),
+				WarmupStrict: config.GetBool("cache.warmup_strict"),
 			},
 			Tpl: TemplateConfig{
 				Enable:     config.GetBool("template.enable"),
@@ -119,15 +248,64 @@ func NewSPAServer() (*SPAServer, error) {
 				Right:      config.GetString("template.right"),
 				MaxSize:    config.GetInt64("template.maxsize"),
 				MaxReplace: config.GetInt("template.maxreplace"),
+				KeepDenied: config.GetBool("template.keep_denied"),
+				Strict:     config.GetBool("template.strict"),
+				Escape:     config.GetStringMap("template.escape"),
+			},
+			Compress: CompressConfig{
+				Precompressed: config.GetStringSlice("compress.precompressed"),
+				Enable:        config.GetBool("compress.enable"),
+				Encodings:     config.GetStringSlice("compress.encodings"),
+				MinSize:       config.GetInt64("compress.minsize"),
+				Types:         config.GetStringSlice("compress.types"),
+			},
+			Runtime: RuntimeConfig{
+				Enable:      config.GetBool("runtime.enable"),
+				Path:        config.GetString("runtime.path"),
+				Var:         config.GetString("runtime.var"),
+				Prefix:      config.GetStringSlice("runtime.prefix"),
+				StripPrefix: config.GetBool("runtime.strip_prefix"),
+				File:        config.GetString("runtime.file"),
+			},
+			Lang: LangConfig{
+				Default:  strings.ToLower(config.GetString("lang.default")),
+				Cookie:   config.GetString("lang.cookie"),
+				Query:    config.GetString("lang.query"),
+				Prefix:   config.GetBool("lang.prefix"),
+				Locales:  config.GetStringSlice("lang.locales"),
+				Redirect: config.GetInt("lang.redirect"),
 			},
 		},
 		headers: config.GetStringMap("headers"),
-		root:    http.Dir(config.GetString("server.root")),
-		cache:   make(map[string]http.File),
 	}
+	if m != nil {
+		srv.cfg.Base = m.Base
+		srv.cfg.Root = m.Root
+		if m.Index != "" {
+			srv.cfg.Index = m.Index
+		}
+		if m.Headers != nil {
+			srv.headers = m.Headers
+		}
+	}
+	srv.root = http.Dir(srv.cfg.Root)
+	srv.cache = NewFileCache(srv.cfg.Cache.MaxMem, srv.cfg.Cache.MaxFiles)
+	srv.mmaps = NewFileCache(srv.cfg.Cache.MmapMaxMem, 0)
+	srv.routes = NewResolveCache(srv.cfg.Cache.MaxRoutes)
+	srv.absent = NewResolveCache(srv.cfg.Cache.MaxRoutes)
 
 	// set max filesize limit
-	MaxFileSize = srv.cfg.Tpl.MaxSize
+	MaxFileSize = srv.cfg.Cache.MaxSize
+
+	// parse request resolution chain
+	tryFiles, err := ParseTryFiles(config.GetStringSlice("server.try_files"))
+	if err != nil {
+		return nil, fmt.Errorf("server.try_files: %v", err)
+	}
+	srv.cfg.TryFiles = tryFiles
+	if err := srv.cfg.Lang.Check(); err != nil {
+		return nil, fmt.Errorf("lang: %v", err)
+	}
 
 	// make sure server root exists and is readable
 	if err := CheckDir(srv.cfg.Root); err != nil {
@@ -139,25 +317,194 @@ func NewSPAServer() (*SPAServer, error) {
 		return nil, fmt.Errorf("server index %v", err)
 	}
 
+	// check precompressed file encodings
+	if err := CheckEncodings(srv.cfg.Compress.Precompressed); err != nil {
+		return nil, fmt.Errorf("compress.precompressed: %v", err)
+	}
+	if err := CheckCompressors(srv.cfg.Compress.Encodings); err != nil {
+		return nil, fmt.Errorf("compress.encodings: %v", err)
+	}
+
 	// parse template matching config
-	if restr := config.GetString("template.match"); len(restr) > 0 {
+	restr := config.GetString("template.match")
+	if m != nil && m.Match != "" {
+		restr = m.Match
+	}
+	if len(restr) > 0 {
 		re, err := regexp.Compile(restr)
 		if err != nil {
 			return nil, fmt.Errorf("parsing 'template.match' regexp: %v", err)
 		}
 		srv.cfg.Tpl.Match = re
-		SetDelims(srv.cfg.Tpl.Left, srv.cfg.Tpl.Right)
-		SetMaxReplace(srv.cfg.Tpl.MaxReplace)
 	}
+	SetDelims(srv.cfg.Tpl.Left, srv.cfg.Tpl.Right)
+	SetMaxReplace(srv.cfg.Tpl.MaxReplace)
+
+	// check default escaping modes
+	if err := CheckEscapes(srv.cfg.Tpl.Escape); err != nil {
+		return nil, fmt.Errorf("template.escape: %v", err)
+	}
+
+	// parse template variable allow and deny lists
+	allow, err := CompileNameList(config.GetStringSlice("template.allow"))
+	if err != nil {
+		return nil, fmt.Errorf("template.allow: %v", err)
+	}
+	deny, err := CompileNameList(config.GetStringSlice("template.deny"))
+	if err != nil {
+		return nil, fmt.Errorf("template.deny: %v", err)
+	}
+	srv.cfg.Tpl.Allow, srv.cfg.Tpl.Deny = allow, deny
+
+	// setup template value sources
+	values, err := NewValuesFromConfig()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read template sources: %v", err)
+	}
+	srv.values.Store(values)
 
 	// parse cache config rules
-	err := config.ForEach("cache.rules", func(c *config.Config) error {
+	if m != nil && m.Rules != nil {
+		srv.cfg.Cache.Rules = m.Rules
+	} else if srv.cfg.Cache.Rules, err = parseCacheRules(config.ForEach, "cache.rules"); err != nil {
+		return nil, fmt.Errorf("cannot read cache config: %v", err)
+	}
+
+	// generate runtime config file, by default it is not cached because
+	// its contents depend on the deployment (see CacheRule)
+	if srv.cfg.Runtime.Enable {
+		if err := srv.cfg.Runtime.Check(); err != nil {
+			return nil, fmt.Errorf("runtime: %v", err)
+		}
+		rt, err := srv.loadRuntimeConfig()
+		if err != nil {
+			return nil, fmt.Errorf("runtime: %v", err)
+		}
+		srv.runtime.Store(rt)
+	}
+
+	// parse cache warmup config
+	if restr := config.GetString("cache.warmup"); len(restr) > 0 {
+		re, err := regexp.Compile(restr)
+		if err != nil {
+			return nil, fmt.Errorf("parsing 'cache.warmup' regexp: %v", err)
+		}
+		srv.cfg.Cache.Warmup = re
+	}
+	return srv, nil
+}
+
+// NewSPAServer creates a server from config, validates templates, starts
+// watching the server root when enabled and warms up the cache.
+func NewSPAServer() (*SPAServer, error) {
+	return newSPAServer(nil)
+}
+
+func newSPAServer(m *MountConfig) (*SPAServer, error) {
+	srv, err := loadSPAServer(m)
+	if err != nil {
+		return nil, err
+	}
+
+	// replace placeholders in extra headers and cache rules
+	if err := srv.expandConfig(); err != nil {
+		return nil, err
+	}
+
+	// snapshot the directory tree for request resolution
+	if srv.cfg.Cache.Index {
+		if err := srv.Reindex(); err != nil {
+			return nil, fmt.Errorf("cannot index server root: %v", err)
+		}
+	}
+
+	// watch server root for changes to keep cached files up to date
+	if srv.cfg.Cache.Watch {
+		srv.watcher, err = NewWatcher(srv.cfg.Root, srv.cfg.Cache.Poll, srv.cfg.Cache.Interval, srv.refresh)
+		if err != nil {
+			return nil, fmt.Errorf("cannot watch server root: %v", err)
+		}
+	}
+
+	// make sure all required template variables are defined and, in strict
+	// mode, all placeholders can be replaced
+	if err := srv.CheckTemplates(); err != nil {
+		srv.Close()
+		return nil, err
+	}
+
+	// load files into cache before accepting requests
+	if err := srv.Warmup(); err != nil {
+		srv.Close()
+		return nil, err
+	}
+	return srv, nil
+}
+
+// Close stops watching the server root for changes.
+func (s *SPAServer) Close() error {
+	s.reindexMu.Lock()
+	if s.reindex != nil {
+		s.reindex.Stop()
+	}
+	s.reindexMu.Unlock()
+	if s.watcher != nil {
+		return s.watcher.Close()
+	}
+	return nil
+}
+
+// refresh reloads cached files after a file or directory under the server
+// root was changed. Files that no longer exist are removed from cache and
+// all remembered path resolutions are dropped.
+func (s *SPAServer) refresh(name string) {
+	// any change may alter how request paths resolve
+	s.routes.Reset()
+	s.absent.Reset()
+	s.scheduleReindex()
+
+	// drop mapped files, they are mapped again on next access
+	for _, n := range s.mmaps.Names() {
+		if isBelow(n, name) {
+			s.mmaps.Remove(n)
+			log.Infof("Removed file %s from cache", n)
+		}
+	}
+	for _, n := range s.cache.Names() {
+		if !isBelow(n, name) {
+			continue
+		}
+		s.cache.Remove(n)
+		f, err := s.root.Open(n)
+		if err != nil {
+			log.Infof("Removed file %s from cache", n)
+			continue
+		}
+		_, err = s.cache.Load(n, s.CacheRule(n).Pin, func() (*CachedFile, error) {
+			return s.loadFile(f, n)
+		})
+		f.Close()
+		if err != nil {
+			log.Infof("Removed file %s from cache: %v", n, err)
+			continue
+		}
+		log.Infof("Refreshed file %s", n)
+	}
+}
+
+// parseCacheRules reads a list of cache rules using the ForEach function of
+// the global config or a sub-config.
+func parseCacheRules(each func(string, func(*config.Config) error) error, path string) ([]CacheRule, error) {
+	var rules []CacheRule
+	err := each(path, func(c *config.Config) error {
 		rule := CacheRule{
-			Filename: c.GetString("filename"),
-			Ignore:   c.GetBool("ignore"),
-			NoCache:  c.GetBool("nocache"),
-			Expires:  c.GetDuration("expires"),
-			Control:  c.GetString("control"),
+			Filename:   c.GetString("filename"),
+			Ignore:     c.GetBool("ignore"),
+			NoCache:    c.GetBool("nocache"),
+			Expires:    c.GetDuration("expires"),
+			Control:    c.GetString("control"),
+			Pin:        c.GetBool("pin"),
+			NoMemCache: c.GetBool("nomemcache"),
 		}
 		if restr := c.GetString("regexp"); len(restr) > 0 {
 			re, err := regexp.Compile(restr)
@@ -166,13 +513,15 @@ func NewSPAServer() (*SPAServer, error) {
 			}
 			rule.Regexp = re
 		}
-		srv.cfg.Cache.Rules = append(srv.cfg.Cache.Rules, rule)
+		rules = append(rules, rule)
 		return nil
 	})
-	if err != nil {
-		return nil, fmt.Errorf("cannot read cache config: %v", err)
-	}
-	return srv, nil
+	return rules, err
+}
+
+// Base returns the base path the server is mounted at.
+func (s *SPAServer) Base() string {
+	return s.cfg.Base
 }
 
 func (s *SPAServer) Address() string {
@@ -218,6 +567,14 @@ func (s *SPAServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	case http.MethodGet:
+		if len(s.cfg.Routes) > 0 && r.URL.Path == s.cfg.Routes {
+			// dump route index for debugging
+			if x := s.Snapshot(); x != nil {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(x)
+				return
+			}
+		}
 		// regular file access
 	default:
 		status = http.StatusMethodNotAllowed
@@ -226,10 +583,21 @@ func (s *SPAServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// strip base path or return 404
-	fullname := strings.TrimPrefix(r.URL.Path, s.cfg.Base)
-	if len(s.cfg.Base) > 0 && len(fullname) == len(r.URL.Path) {
-		status = http.StatusNotFound
-		http.NotFound(w, r)
+	fullname := cleanPath(r.URL.Path)
+	if base := normalizeBase(s.cfg.Base); base != "" {
+		if !isBelow(fullname, base) {
+			status = http.StatusNotFound
+			http.NotFound(w, r)
+			return
+		}
+		fullname = cleanPath(strings.TrimPrefix(fullname, base))
+	}
+
+	// redirect to the negotiated locale in locale routing mode
+	if target, ok := s.localeRedirect(r, fullname); ok {
+		s.setVaryLang(w.Header())
+		status = s.cfg.Lang.Redirect
+		http.Redirect(w, r, target, status)
 		return
 	}
 
@@ -239,7 +607,11 @@ func (s *SPAServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// - may return a cached file
 	f, name, err := s.TryFile(r, fullname)
 	if err != nil {
+		se, isStatus := err.(StatusError)
 		switch true {
+		case isStatus:
+			status = int(se)
+			http.Error(w, http.StatusText(status), status)
 		case os.IsNotExist(err):
 			status = http.StatusNotFound
 			http.NotFound(w, r)
@@ -247,7 +619,7 @@ func (s *SPAServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			status = http.StatusForbidden
 			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
 		default:
-			log.Errorf("Opening file %s: %v", fullname[:32], err)
+			log.Errorf("Opening file %s: %v", name, err)
 			status = http.StatusInternalServerError
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		}
@@ -258,20 +630,58 @@ func (s *SPAServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	defer func() {
 		f.Close()
 	}()
+
+	// prefer a precompressed sibling file when the client accepts it, cache
+	// rules and content type are still derived from the original file name
+	fname := name
+	if s.usePrecompressed(name) {
+		addVary(w.Header(), "Accept-Encoding")
+		ef, ename, enc, err := s.TryEncoded(r, name)
+		if err != nil {
+			log.Warnf("Opening file %s: %v", ename, err)
+		} else if ef != nil {
+			f.Close()
+			f, fname = ef, ename
+			w.Header().Set("Content-Encoding", enc)
+			w.Header().Set("Content-Type", contentType(name))
+		}
+	}
+	s.setLangHeaders(w, fullname, name)
 	fi, _ := f.Stat()
+	rv := s.newRequestValues(r)
+	rv.Lang = s.requestLang(r, name)
+
+	// large templates are replaced while streaming them from disk, this
+	// includes templates above the file cache limit which would otherwise be
+	// sent unreplaced
+	if !IsCached(f) && s.isTemplate(fname) && (fi.Size() > s.cfg.Tpl.MaxSize || fi.Size() > MaxFileSize) {
+		s.streamTemplate(w, r, f, name, rv, start)
+		return
+	}
 
-	if !IsCached(f) {
-		if cf, err := NewCachedFile(f); err == nil {
+	if !IsCached(f) && fi.Size() > MaxFileSize {
+		// large files are memory mapped when enabled or sent straight from
+		// disk which allows the kernel to use sendfile
+		if mf := s.mapFile(f, fname, fi.Size()); mf != nil {
+			f.Close()
+			f = mf
+		}
+	} else if rule := s.CacheRule(name); !IsCached(f) && (!rule.NoMemCache || s.isTemplate(fname)) {
+		var cf *CachedFile
+		if rule.NoMemCache {
+			// template-replace, but don't keep in memory
+			cf, err = s.loadFile(f, fname)
+		} else {
+			// load and template-replace the file once, concurrent requests for
+			// the same file wait for the first load to complete
+			cf, err = s.cache.Load(fname, rule.Pin, func() (*CachedFile, error) {
+				return s.loadFile(f, fname)
+			})
+		}
+		if err == nil {
 			f.Close()
-			// try replace template variables
-			if s.cfg.Tpl.Enable && s.cfg.Tpl.Match != nil && s.cfg.Tpl.Match.MatchString(name) {
-				log.Debugf("Replacing templates in file %s", name)
-				cf.ReplaceTemplates()
-			}
 			f = cf
 			fi, _ = f.Stat()
-			log.Debugf("Caching file %s", name)
-			s.cache[name] = f
 		} else if err != io.ErrShortBuffer {
 			switch true {
 			case os.IsNotExist(err):
@@ -281,47 +691,120 @@ func (s *SPAServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				status = http.StatusForbidden
 				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
 			default:
-				log.Errorf("Caching file %s: %v", fullname[:32], err)
+				log.Errorf("Caching file %s: %v", fname, err)
 				status = http.StatusInternalServerError
 				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			}
 			return
 		} else {
-			log.Warnf("Caching file %s failed: %v", name, err)
+			// file has grown since we checked its size
+			log.Debugf("Caching file %s failed: %v", fname, err)
 		}
 		// don't cache or template-replace files on error (they may be too big to cache)
 	}
 
-	// write response headers
-	s.WriteHeaders(w, r, f, start)
+	// render request-specific placeholders, the result differs on every
+	// request so it is neither compressed nor revalidated
+	modtime := fi.ModTime()
+	rendered := false
+	if cf, ok := f.(*CachedFile); ok && cf.tpl != nil {
+		f, rendered = cf.Render(rv), true
+		fi, _ = f.Stat()
+		modtime = time.Time{}
+	}
+
+	// serve a compressed variant of a cached file when the client accepts
+	// it, range requests are always served from the uncompressed file
+	if cf, ok := f.(*CachedFile); ok && fname == name && len(cf.enc) > 0 {
+		addVary(w.Header(), "Accept-Encoding")
+		if r.Header.Get("Range") == "" {
+			if encs := NegotiateEncoding(r.Header.Get("Accept-Encoding"), cf.Encodings()); len(encs) > 0 {
+				f = cf.Encoded(encs[0])
+				fi, _ = f.Stat()
+				w.Header().Set("Content-Encoding", encs[0])
+				w.Header().Set("Content-Type", contentType(name))
+			}
+		}
+	}
+
+	// write response headers, rendered responses are unique to a request
+	// and must never be stored whatever the cache rule says
+	s.WriteHeaders(w, r, name, rv, start)
+	if rendered {
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Del("Expires")
+	}
+
+	// set validators, http.ServeContent evaluates conditional requests
+	if cf, ok := f.(*CachedFile); ok && !rendered {
+		if s.cfg.Cache.ETag {
+			w.Header().Set("ETag", cf.ETag())
+		}
+		if d := cf.Digest(); s.cfg.Cache.Digest && d != "" {
+			w.Header().Set("Repr-Digest", d)
+		}
+	} else if s.cfg.Cache.ETag && !rendered {
+		w.Header().Set("ETag", WeakETag(fi))
+	}
 
 	// send file
-	http.ServeContent(w, r, name, fi.ModTime(), f)
+	http.ServeContent(w, r, name, modtime, f)
 }
 
-func (s *SPAServer) WriteHeaders(w http.ResponseWriter, r *http.Request, f http.File, start time.Time) {
-	fi, _ := f.Stat()
-	name := fi.Name()
+// loadFile reads an open file into memory, replaces template variables
+// when the file name matches the template config and adds compressed
+// variants when enabled.
+func (s *SPAServer) loadFile(f http.File, name string) (*CachedFile, error) {
+	if fi, err := f.Stat(); err == nil && s.isTemplate(name) && fi.Size() > s.cfg.Tpl.MaxSize {
+		// too large for in-memory replacement, streamed instead
+		return nil, io.ErrShortBuffer
+	}
+	cf, err := NewCachedFile(f)
+	if err != nil {
+		return nil, err
+	}
+	if s.isTemplate(name) {
+		log.Debugf("Replacing templates in file %s", name)
+		if err := s.replaceTemplates(cf, name); err != nil {
+			return nil, err
+		}
+	}
+	// compressed variants only pay off for files kept in memory and sent
+	// as is
+	if !s.CacheRule(name).NoMemCache && cf.tpl == nil && s.useCompression(name, cf.fi.size) {
+		log.Debugf("Compressing file %s", name)
+		if err := cf.Compress(s.cfg.Compress.Encodings); err != nil {
+			return nil, err
+		}
+	}
+	log.Debugf("Loading file %s", name)
+	return cf, nil
+}
+
+// mapFile returns a memory mapped version of a large file or nil when the
+// file should be served from disk.
+func (s *SPAServer) mapFile(f http.File, name string, size int64) *CachedFile {
+	if !s.cfg.Cache.Mmap || s.CacheRule(name).NoMemCache || size > s.cfg.Cache.MmapMaxMem {
+		log.Debugf("Serving large file %s from disk", name)
+		return nil
+	}
+	mf, err := s.mmaps.Load(name, false, func() (*CachedFile, error) {
+		log.Debugf("Mapping file %s", name)
+		return NewMappedFile(f)
+	})
+	if err != nil {
+		log.Debugf("Mapping file %s failed, serving from disk: %v", name, err)
+		return nil
+	}
+	return mf
+}
+
+func (s *SPAServer) WriteHeaders(w http.ResponseWriter, r *http.Request, name string, rv *RequestValues, start time.Time) {
 	h := w.Header()
 
 	// set cache headers based on filename and rules
 	if s.cfg.Cache.Enable {
-		rule := CacheRule{
-			Expires: s.cfg.Cache.Expires,
-			Control: s.cfg.Cache.Control,
-		}
-		for _, v := range s.cfg.Cache.Rules {
-			if len(v.Filename) > 0 && v.Filename == name {
-				log.Debugf("Using filename cache rule %#v", v)
-				rule = v
-				break
-			}
-			if v.Regexp != nil && v.Regexp.MatchString(name) {
-				log.Debugf("Using regexp cache rule %#v", v)
-				rule = v
-				break
-			}
-		}
+		rule := s.CacheRule(name)
 		if !rule.Ignore {
 			if rule.NoCache {
 				w.Header().Set("Cache-Control", "max-age=0, no-cache, no-store, must-revalidate")
@@ -335,118 +818,120 @@ func (s *SPAServer) WriteHeaders(w http.ResponseWriter, r *http.Request, f http.
 	}
 
 	// set extra headers
-	rid := r.Header.Get("X-Request-Id")
-	if rid == "" {
-		rid = "SV-" + <-idStream
+	h.Set("X-Request-Id", rv.ID)
+
+	for n, v := range s.expanded().headers {
+		h.Add(n, rv.Expand(v))
 	}
-	h.Set("X-Request-Id", rid)
+}
 
-	for n, v := range s.headers {
-		h.Add(n, v)
+// CacheRule returns the first cache rule matching the base name of a file
+// or a default rule built from the global cache config. Unless a rule
+// matches, the runtime config file is never cached.
+func (s *SPAServer) CacheRule(name string) CacheRule {
+	base := path.Base(name)
+	for _, v := range s.expanded().rules {
+		if len(v.Filename) > 0 && v.Filename == base {
+			log.Debugf("Using filename cache rule %#v", v)
+			return v
+		}
+		if v.Regexp != nil && v.Regexp.MatchString(base) {
+			log.Debugf("Using regexp cache rule %#v", v)
+			return v
+		}
+	}
+	if s.runtimeConfig() != nil && name == s.cfg.Runtime.Path {
+		return CacheRule{NoCache: true}
+	}
+	return CacheRule{
+		Expires: s.cfg.Cache.Expires,
+		Control: s.cfg.Cache.Control,
 	}
 }
 
+// isTemplate returns true when template replacement is enabled for a file.
+func (s *SPAServer) isTemplate(name string) bool {
+	return s.cfg.Tpl.Enable && s.cfg.Tpl.Match != nil && s.cfg.Tpl.Match.MatchString(name)
+}
+
+// TryFile resolves a request path to a file, trying fallbacks like index
+// files when no exact match exists. Successful resolutions are remembered
+// per path and accepted languages.
 func (s *SPAServer) TryFile(r *http.Request, name string) (http.File, string, error) {
-	// lookup cache
-	log.Debugf("Try cache lookup for file %s", s.cfg.Root+name)
-	f, ok := s.cache[name]
-	if ok {
-		return f, name, nil
+	var langs []string
+	if s.hasLangPatterns() {
+		langs = s.acceptedLangs(r)
+	}
+	key := name + "|" + strings.Join(langs, ",")
+	if rname, ok := s.routes.Get(key); ok {
+		log.Debugf("Resolved %s to %s", name, rname)
+		if f := s.cached(rname); f != nil {
+			return f, rname, nil
+		}
+		f, err := s.root.Open(rname)
+		if err == nil {
+			return f, rname, nil
+		}
+		// file has vanished, resolve again
 	}
+	f, rname, err := s.tryFile(name, langs)
+	if err == nil {
+		s.routes.Add(key, rname)
+	}
+	return f, rname, err
+}
 
-	// check if file exists
+// probe returns a cached or opened file or nil when name does not exist or
+// is a directory. When a route index is available, names missing from the
+// index are rejected without touching the filesystem.
+func (s *SPAServer) probe(name string) (http.File, error) {
+	log.Debugf("Try cache lookup for file %s", s.cfg.Root+name)
+	if f := s.cached(name); f != nil {
+		return f, nil
+	}
+	if x := s.Snapshot(); x != nil && !x.IsFile(name) {
+		return nil, nil
+	}
 	log.Debugf("Try opening file %s", s.cfg.Root+name)
 	f, err := s.root.Open(name)
-	if err == nil {
-		fi, _ := f.Stat()
-		if !fi.IsDir() {
-			return f, name, nil
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
 		}
+		return nil, err
+	}
+	if fi, _ := f.Stat(); fi.IsDir() {
 		f.Close()
-	} else if !os.IsNotExist(err) {
-		return nil, name, err
+		return nil, nil
 	}
+	return f, nil
+}
 
-	// try with .html extension if missing
-	if !strings.HasSuffix(name, "/") && !strings.HasSuffix(name, ".html") {
-		extname := name + ".html"
-		log.Debugf("Try cache lookup for file %s", s.cfg.Root+extname)
-		f, ok := s.cache[extname]
-		if ok {
-			return f, extname, nil
-		}
-		log.Debugf("Try opening file %s", s.cfg.Root+extname)
-		f, err := s.root.Open(extname)
-		if err == nil {
-			fi, _ := f.Stat()
-			if !fi.IsDir() {
-				return f, extname, nil
-			}
-			f.Close()
-		} else if !os.IsNotExist(err) {
-			return nil, extname, err
-		}
-	}
-
-	// try index file lookups from the current directory upwards
-	segments := strings.Split(name, "/")
-	for i := len(segments); i > 0; i-- {
-		path := strings.Join(segments[0:i], "/")
-		// try lang-specific *-index.html matches first
-		// en-US,en;q=0.5
-		langs := strings.Split(r.Header.Get("Accept-Language"), ";")[0]
-		if len(langs) > 0 {
-			for _, v := range strings.Split(langs, ",") {
-				v = strings.ToLower(strings.TrimSpace(v))
-				name = path + "/" + v + "-" + s.cfg.Index
-				log.Debugf("Try cache lookup for file %s", s.cfg.Root+name)
-				f, ok := s.cache[name]
-				if ok {
-					return f, name, nil
-				}
-				log.Debugf("Try opening file %s", s.cfg.Root+name)
-				f, err = s.root.Open(name)
-				if err == nil {
-					fi, _ := f.Stat()
-					if !fi.IsDir() {
-						return f, name, nil
-					}
-					f.Close()
-				} else if !os.IsNotExist(err) {
-					return nil, name, err
-				}
-			}
-		}
-		// try index.html
-		name = path + "/" + s.cfg.Index
-		log.Debugf("Try cache lookup for file %s", s.cfg.Root+name)
-		f, ok = s.cache[name]
-		if ok {
-			return f, name, nil
-		}
-		log.Debugf("Try opening file %s", s.cfg.Root+name)
-		f, err = s.root.Open(name)
-		if err == nil {
-			fi, _ := f.Stat()
-			if !fi.IsDir() {
-				return f, name, nil
-			}
-			f.Close()
-		} else if !os.IsNotExist(err) {
-			return nil, name, err
-		}
+// isBelow returns true when name equals dir or is a path inside dir.
+func isBelow(name, dir string) bool {
+	return name == dir || strings.HasPrefix(name, strings.TrimSuffix(dir, "/")+"/")
+}
+
+// cached returns a cached or memory mapped file or nil. The runtime config
+// file is always cached.
+func (s *SPAServer) cached(name string) *CachedFile {
+	if rt := s.runtimeConfig(); rt != nil && name == s.cfg.Runtime.Path {
+		return rt.Clone()
+	}
+	if f := s.cache.Get(name); f != nil {
+		return f
 	}
+	return s.mmaps.Get(name)
+}
 
-	// fallback to root index.html
-	name = "/" + s.cfg.Index
-	log.Debugf("Try cache lookup for file %s", s.cfg.Root+name)
-	f, ok = s.cache[name]
-	if ok {
-		return f, name, nil
+// cleanPath returns the canonical form of a request path with leading slash
+// and without dot segments. Like in net/http a trailing slash is retained.
+func cleanPath(p string) string {
+	np := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && np != "/" {
+		np += "/"
 	}
-	log.Debugf("Try opening file %s", s.cfg.Root+name)
-	f, err = s.root.Open(name)
-	return f, name, err
+	return np
 }
 
 type AccessLog struct {
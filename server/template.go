@@ -0,0 +1,496 @@
+// Copyright (c) 2019-2020 KIDTSUNAMI
+// Author: alex@kidtsunami.com
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/echa/log"
+)
+
+// CompileNameList compiles a list of variable name patterns. Patterns are Go
+// regexps anchored at the start of the name, so a plain prefix like `APP_`
+// matches all names starting with it.
+func CompileNameList(list []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, 0, len(list))
+	for _, v := range list {
+		if v == "" {
+			continue
+		}
+		re, err := regexp.Compile("^(?:" + v + ")")
+		if err != nil {
+			return nil, fmt.Errorf("parsing name pattern '%s': %v", v, err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+func matchAny(list []*regexp.Regexp, s string) bool {
+	for _, re := range list {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAllowed returns true when a template variable may be exposed. Names are
+// checked without source prefix. Deny patterns take precedence over allow
+// patterns and an empty allow list allows all names.
+func (c TemplateConfig) IsAllowed(key string) bool {
+	_, key = SplitKey(key)
+	if matchAny(c.Deny, key) {
+		return false
+	}
+	return len(c.Allow) == 0 || matchAny(c.Allow, key)
+}
+
+// MissingError lists required template variables without value together
+// with the files referencing them.
+type MissingError map[string][]string
+
+func (e MissingError) add(key, name string) {
+	for _, v := range e[key] {
+		if v == name {
+			return
+		}
+	}
+	e[key] = append(e[key], name)
+}
+
+func (e MissingError) Error() string {
+	keys := make([]string, 0, len(e))
+	for k := range e {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	list := make([]string, len(keys))
+	for i, k := range keys {
+		list[i] = k + " (" + strings.Join(e[k], ", ") + ")"
+	}
+	return "missing required template variables: " + strings.Join(list, ", ")
+}
+
+// placeholder states in template reports
+const (
+	TemplateOK           = "ok"
+	TemplateDefault      = "default"      // variable undefined, default value used
+	TemplateRequest      = "request"      // variable rendered per request
+	TemplateDirective    = "directive"    // conditional section directive
+	TemplateInactive     = "inactive"     // placeholder in inactive section
+	TemplateUndefined    = "undefined"    // variable undefined, replaced by empty string
+	TemplateMissing      = "missing"      // required variable undefined
+	TemplateDenied       = "denied"       // variable not allowed
+	TemplateInvalid      = "invalid"      // placeholder cannot be parsed
+	TemplateOversize     = "oversize"     // placeholder too long, left unreplaced
+	TemplateUnterminated = "unterminated" // end delimiter missing
+)
+
+// resolve looks up the value of a placeholder and returns it together with
+// the placeholder state.
+func (s *SPAServer) resolve(p Placeholder) (string, string) {
+	if isRequestKey(p.Key) {
+		return "", TemplateRequest
+	}
+	if !s.cfg.Tpl.IsAllowed(p.Key) {
+		return "", TemplateDenied
+	}
+	if val, ok := s.Values().Lookup(p.Key); ok {
+		return val, TemplateOK
+	}
+	if def, ok := p.Default(); ok {
+		return def, TemplateDefault
+	}
+	if p.IsRequired() {
+		return "", TemplateMissing
+	}
+	return "", TemplateUndefined
+}
+
+// lookup resolves a placeholder. It returns the unescaped value and false
+// when the placeholder must be left unreplaced. Undefined variables use the
+// placeholder's default value, required variables without value are added
+// to missing.
+func (s *SPAServer) lookup(p Placeholder, name string, missing MissingError) (string, bool) {
+	val, state := s.resolve(p)
+	switch state {
+	case TemplateDenied:
+		log.Warnf("Template variable '%s' in %s is not allowed", p.Key, name)
+		if p.IsRequired() {
+			missing.add(p.Key, name)
+		}
+		return "", !s.cfg.Tpl.KeepDenied
+	case TemplateMissing:
+		missing.add(p.Key, name)
+	}
+	return val, true
+}
+
+// replacer replaces placeholders in a single template. Values are escaped
+// according to placeholder filters or the default escaping mode. Disallowed
+// variables are either left unreplaced or replaced by an empty string.
+// Directives update conditional sections and placeholders in inactive
+// sections are dropped.
+type replacer struct {
+	s       *SPAServer
+	name    string                   // template name for logs and errors
+	escape  string                   // default escaping filter
+	missing MissingError             // required variables without value
+	sec     *Sections                // conditional sections
+	err     error                    // first directive error
+	mask    bool                     // replace values with asterisks
+	req     func(Placeholder) string // handles request-specific placeholders
+}
+
+// newReplacer returns a replacer that keeps request-specific placeholders.
+func (s *SPAServer) newReplacer(name, escape string) *replacer {
+	r := &replacer{
+		s:       s,
+		name:    name,
+		escape:  escape,
+		missing: make(MissingError),
+		sec:     NewSections(s.evalCondition),
+	}
+	r.req = r.keep
+	return r
+}
+
+func (r *replacer) keep(p Placeholder) string {
+	return string(startDelim) + p.String() + string(endDelim)
+}
+
+// Replace returns the replacement for the text between template delimiters.
+func (r *replacer) Replace(v string) string {
+	if ok, err := r.sec.Handle(v); ok {
+		if err != nil && r.err == nil {
+			r.err = fmt.Errorf("%s: directive '%s': %v", r.name, v, err)
+		}
+		return ""
+	}
+	if !r.sec.Active() {
+		return ""
+	}
+	p, err := ParsePlaceholder(v)
+	if err == nil && isRequestKey(p.Key) {
+		err = checkRequestKey(p.Key)
+	}
+	if err != nil {
+		log.Warnf("Invalid template placeholder '%s' in %s: %v", v, r.name, err)
+		return string(startDelim) + v + string(endDelim)
+	}
+	if isRequestKey(p.Key) {
+		return r.req(p)
+	}
+	val, ok := r.s.lookup(p, r.name, r.missing)
+	if !ok {
+		return string(startDelim) + v + string(endDelim)
+	}
+	masked := strings.Repeat("*", len(val))
+	log.Debugf("Replacing '%s' with '%s'", p.Key, masked)
+	if r.mask {
+		return masked
+	}
+	return p.Apply(val, r.escape)
+}
+
+// Close fails on invalid directives, unclosed sections or required
+// variables without value.
+func (r *replacer) Close() error {
+	if r.err == nil {
+		if err := r.sec.Close(); err != nil {
+			r.err = fmt.Errorf("%s: %v", r.name, err)
+		}
+	}
+	if r.err != nil {
+		return r.err
+	}
+	if len(r.missing) > 0 {
+		return r.missing
+	}
+	return nil
+}
+
+// replaceTemplates resolves all placeholders in the template file name and
+// fails when required variables have no value. Request-specific placeholders
+// are removed and their positions recorded for rendering them per request.
+func (s *SPAServer) replaceTemplates(f *CachedFile, name string) error {
+	var (
+		r   = s.newReplacer(name, s.cfg.Tpl.escapeMode(name))
+		tpl = &requestTemplate{escape: r.escape}
+		off int
+	)
+	r.req = func(p Placeholder) string {
+		tpl.add(off, p)
+		return ""
+	}
+	f.ReplaceTemplates(r.sec, func(v string, o int) string {
+		off = o
+		return r.Replace(v)
+	})
+	if err := r.Close(); err != nil {
+		return err
+	}
+	f.tpl = nil
+	if len(tpl.offs) > 0 {
+		f.tpl = tpl
+	}
+	return nil
+}
+
+// streamTemplate sends a template file too large for in-memory replacement
+// and replaces placeholders while reading it. Because the response size is
+// unknown in advance, range and conditional requests are not supported.
+// Required variables without value can only be logged since the response
+// has already started.
+func (s *SPAServer) streamTemplate(w http.ResponseWriter, r *http.Request, f http.File, name string, rv *RequestValues, start time.Time) {
+	rp := s.newReplacer(name, s.cfg.Tpl.escapeMode(name))
+	rp.req = func(p Placeholder) string {
+		val, _ := rv.Lookup(p.Key)
+		return p.Apply(val, rp.escape)
+	}
+	rd := NewTemplateReader(f, rp.sec, rp.Replace)
+	log.Debugf("Streaming template file %s", name)
+	s.WriteHeaders(w, r, name, rv, start)
+	w.Header().Set("Content-Type", contentType(name))
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(w, rd); err != nil {
+		log.Debugf("Streaming file %s: %v", name, err)
+	}
+	if err := rp.Close(); err != nil {
+		log.Errorf("Streaming file %s: %v", name, err)
+	}
+}
+
+// Render writes the template file name with all placeholders replaced to w.
+// Request-specific placeholders are kept. With mask all values are replaced
+// by asterisks so secrets don't leak into terminals and CI logs.
+func (s *SPAServer) Render(w io.Writer, name string, mask bool) error {
+	name = cleanPath(name)
+	if !s.isTemplate(name) {
+		log.Warnf("File %s does not match template.match and is served as is", name)
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(s.cfg.Root, filepath.FromSlash(name)))
+	if err != nil {
+		return err
+	}
+	r := s.newReplacer(name, s.cfg.Tpl.escapeMode(name))
+	r.mask = mask
+	FindAndReplace(buf, sectionWriter{w: w, sec: r.sec}, r.Replace)
+	return r.Close()
+}
+
+// evalCondition evaluates the condition of an if directive. Disallowed
+// variables are treated as undefined.
+func (s *SPAServer) evalCondition(c Condition) bool {
+	if !s.cfg.Tpl.IsAllowed(c.Key) {
+		log.Warnf("Template variable '%s' in condition is not allowed", c.Key)
+		return c.Eval("", false)
+	}
+	val, ok := s.Values().Lookup(c.Key)
+	return c.Eval(val, ok)
+}
+
+// walkTemplates calls fn with the contents of every template file below the
+// server root, including files that are streamed when served. Files larger
+// than a non-zero max size are skipped.
+func (s *SPAServer) walkTemplates(max int64, fn func(name string, buf []byte) error) error {
+	if !s.cfg.Tpl.Enable || s.cfg.Tpl.Match == nil {
+		return nil
+	}
+	return filepath.Walk(s.cfg.Root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name := relName(s.cfg.Root, p)
+		if fi.IsDir() || !s.isTemplate(name) {
+			return nil
+		}
+		if max > 0 && fi.Size() > max {
+			log.Debugf("Skipping check of large template file %s", name)
+			return nil
+		}
+		buf, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		return fn(name, buf)
+	})
+}
+
+// TemplateRef is a placeholder found in a template file.
+type TemplateRef struct {
+	File      string `json:"file"`
+	Line      int    `json:"line"`
+	Text      string `json:"text"`
+	Key       string `json:"key,omitempty"`
+	Required  bool   `json:"required,omitempty"`
+	State     string `json:"state"`
+	Error     string `json:"error,omitempty"`
+	Directive string `json:"directive,omitempty"`
+}
+
+// IsProblem returns true when the placeholder cannot be replaced as intended.
+func (r TemplateRef) IsProblem() bool {
+	switch r.State {
+	case TemplateOK, TemplateDefault, TemplateRequest, TemplateDirective, TemplateInactive:
+		return false
+	default:
+		return true
+	}
+}
+
+func (r TemplateRef) String() string {
+	end := string(endDelim)
+	if r.State == TemplateOversize || r.State == TemplateUnterminated {
+		end = "..."
+	}
+	s := fmt.Sprintf("%s:%d: %s%s%s %s", r.File, r.Line, startDelim, r.Text, end, r.State)
+	if r.Error != "" {
+		s += ": " + r.Error
+	}
+	return s
+}
+
+// TemplateReport scans all template files, extra headers and cache rules
+// and returns every placeholder with its location and state, ordered by file
+// and line.
+func (s *SPAServer) TemplateReport() ([]TemplateRef, error) {
+	return s.templateReport(0)
+}
+
+// templateReport is like TemplateReport but skips template files larger
+// than a non-zero max size.
+func (s *SPAServer) templateReport(max int64) ([]TemplateRef, error) {
+	refs := make([]TemplateRef, 0)
+	err := s.walkTemplates(max, func(name string, buf []byte) error {
+		refs = append(refs, s.scanRefs(name, buf)...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	headers := make([]string, 0, len(s.headers))
+	for n := range s.headers {
+		headers = append(headers, n)
+	}
+	sort.Strings(headers)
+	for _, n := range headers {
+		refs = append(refs, s.scanRefs("header "+n, []byte(s.headers[n]))...)
+	}
+	for i, v := range s.cfg.Cache.Rules {
+		refs = append(refs, s.scanRefs(fmt.Sprintf("cache rule %d", i), []byte(v.Control))...)
+	}
+	return refs, nil
+}
+
+// scanRefs returns all placeholders in buf with their state.
+func (s *SPAServer) scanRefs(name string, buf []byte) []TemplateRef {
+	var (
+		refs []TemplateRef
+		sec  = NewSections(s.evalCondition)
+		ifs  []TemplateRef // open if directives
+	)
+	for _, m := range ScanTemplates(buf) {
+		ref := TemplateRef{File: name, Line: m.Line, Text: m.Text}
+		kind, cond, _ := ParseDirective(m.Text)
+		switch {
+		case m.IsUnterminated():
+			ref.State = TemplateUnterminated
+		case m.IsOversize():
+			ref.State = TemplateOversize
+			ref.Error = fmt.Sprintf("%d bytes exceed max replace size %d", m.End-m.Start, maxReplace)
+		case kind != "":
+			ref.Directive, ref.Key, ref.State = kind, cond.Key, TemplateDirective
+			if _, err := sec.Handle(m.Text); err != nil {
+				ref.State, ref.Error = TemplateInvalid, err.Error()
+				break
+			}
+			switch kind {
+			case directiveIf:
+				ifs = append(ifs, ref)
+			case directiveEnd:
+				ifs = ifs[:len(ifs)-1]
+			}
+		case !sec.Active():
+			ref.State = TemplateInactive
+		default:
+			p, err := ParsePlaceholder(m.Text)
+			if err == nil && isRequestKey(p.Key) {
+				err = checkRequestKey(p.Key)
+			}
+			if err != nil {
+				ref.State = TemplateInvalid
+				ref.Error = err.Error()
+				break
+			}
+			ref.Key, ref.Required = p.Key, p.IsRequired()
+			_, ref.State = s.resolve(p)
+		}
+		refs = append(refs, ref)
+	}
+	for _, ref := range ifs {
+		ref.State, ref.Error = TemplateInvalid, "unclosed if"
+		refs = append(refs, ref)
+	}
+	return refs
+}
+
+// CheckTemplates scans all template files and fails when required variables
+// have no value, listing every missing variable and the files referencing
+// it. Invalid or unbalanced directives always fail. In strict mode every
+// placeholder is reported and any problem, like unknown variables or
+// oversize and unterminated placeholders, fails. Outside strict mode files
+// above the template max size are not read, they are too large to check
+// quickly.
+func (s *SPAServer) CheckTemplates() error {
+	max := s.cfg.Tpl.MaxSize
+	if s.cfg.Tpl.Strict {
+		max = 0
+	}
+	refs, err := s.templateReport(max)
+	if err != nil {
+		return err
+	}
+	var (
+		missing  = make(MissingError)
+		problems []string
+		nesting  []string
+	)
+	for _, r := range refs {
+		if s.cfg.Tpl.Strict {
+			log.Infof("Template %s", r)
+		} else {
+			log.Debugf("Template %s", r)
+		}
+		if r.Required && (r.State == TemplateMissing || r.State == TemplateDenied) {
+			missing.add(r.Key, r.File)
+		}
+		if r.IsProblem() {
+			problems = append(problems, r.String())
+		}
+		if r.Directive != "" && r.State == TemplateInvalid {
+			nesting = append(nesting, r.String())
+		}
+	}
+	if len(nesting) > 0 {
+		return fmt.Errorf("invalid template directives:\n  %s", strings.Join(nesting, "\n  "))
+	}
+	if len(missing) > 0 {
+		return missing
+	}
+	if s.cfg.Tpl.Strict && len(problems) > 0 {
+		return fmt.Errorf("template validation failed with %d problems:\n  %s", len(problems), strings.Join(problems, "\n  "))
+	}
+	return nil
+}
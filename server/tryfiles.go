@@ -0,0 +1,160 @@
+// Copyright (c) 2019-2020 KIDTSUNAMI
+// Author: alex@kidtsunami.com
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// pattern of language-specific index files, their languages are known from
+// the route index
+const langIndexPattern = "$dir/{lang}-$index"
+
+// default request resolution: exact file, `.html` extension, language
+// specific and plain index files from the request path upwards
+var defaultTryFiles = []string{
+	"$uri",
+	"$uri.html",
+	langIndexPattern,
+	"$dir/$index",
+}
+
+// variables allowed in try_files patterns
+var tryVarRegexp = regexp.MustCompile(`\$[a-z]+|\{[a-z]+\}`)
+
+// TryPattern is a parsed try_files pattern.
+type TryPattern struct {
+	Pattern string
+	Status  int  // response status of `=code` patterns
+	Walk    bool // pattern is tried for each directory from the request path upwards
+	Lang    bool // pattern is tried for each accepted language
+	Ext     bool // pattern appends a suffix to the request path
+}
+
+// StatusError is returned when request resolution ends with an `=code`
+// try_files pattern.
+type StatusError int
+
+func (e StatusError) Error() string {
+	return http.StatusText(int(e))
+}
+
+// ParseTryFiles parses and validates an ordered list of try_files patterns.
+// Patterns are absolute paths that may use `$uri` (request path), `$dir`
+// (each directory from the request path upwards), `$index` (index file
+// name) and `{lang}` (each accepted language). A final `=code` pattern
+// responds with the status code.
+func ParseTryFiles(list []string) ([]TryPattern, error) {
+	if len(list) == 0 {
+		return nil, fmt.Errorf("empty list")
+	}
+	res := make([]TryPattern, 0, len(list))
+	for i, v := range list {
+		v = strings.TrimSpace(v)
+		p := TryPattern{Pattern: v}
+		if strings.HasPrefix(v, "=") {
+			code, err := strconv.Atoi(v[1:])
+			if err != nil || code < 400 || code > 599 {
+				return nil, fmt.Errorf("invalid status pattern '%s'", v)
+			}
+			if i != len(list)-1 {
+				return nil, fmt.Errorf("status pattern '%s' must be last", v)
+			}
+			p.Status = code
+			res = append(res, p)
+			continue
+		}
+		for _, m := range tryVarRegexp.FindAllStringIndex(v, -1) {
+			switch name := v[m[0]:m[1]]; name {
+			case "$uri", "$dir":
+				if m[0] != 0 {
+					return nil, fmt.Errorf("'%s' must start pattern '%s'", name, v)
+				}
+				p.Walk = name == "$dir"
+				p.Ext = name == "$uri" && m[1] < len(v) && v[m[1]] != '/'
+			case "$index":
+			case "{lang}":
+				p.Lang = true
+			default:
+				return nil, fmt.Errorf("unknown variable '%s' in pattern '%s'", name, v)
+			}
+		}
+		if !strings.HasPrefix(v, "$") && !strings.HasPrefix(v, "/") {
+			return nil, fmt.Errorf("pattern '%s' must be an absolute path", v)
+		}
+		res = append(res, p)
+	}
+	return res, nil
+}
+
+// expand returns the file name for a request path, directory and language.
+func (p TryPattern) expand(uri, dir, index, lang string) string {
+	r := strings.NewReplacer("$uri", uri, "$dir", dir, "$index", index, "{lang}", lang)
+	return path.Join("/", r.Replace(p.Pattern))
+}
+
+// tryPattern tries a single pattern for all accepted languages.
+func (s *SPAServer) tryPattern(p TryPattern, uri, dir string, langs []string) (http.File, string, error) {
+	if p.Ext {
+		// don't append suffixes to directories or names that already have them
+		suffix := strings.TrimPrefix(p.Pattern, "$uri")
+		if strings.HasSuffix(uri, "/") || strings.HasSuffix(uri, suffix) {
+			return nil, "", nil
+		}
+	}
+	if !p.Lang {
+		langs = []string{""}
+	} else if x := s.Snapshot(); x != nil && p.Pattern == langIndexPattern {
+		// only try languages with an index variant in dir
+		langs = x.filterLangs(path.Join("/", dir), langs)
+	}
+	for _, lang := range langs {
+		name := p.expand(uri, dir, s.cfg.Index, lang)
+		if f, err := s.probe(name); f != nil || err != nil {
+			return f, name, err
+		}
+	}
+	return nil, "", nil
+}
+
+// tryFile resolves a request path using the try_files patterns. Consecutive
+// patterns using `$dir` are tried together for each directory from the
+// request path upwards. Language patterns are tried for each accepted
+// language in order of preference.
+func (s *SPAServer) tryFile(name string, accepted []string) (http.File, string, error) {
+	list := s.cfg.TryFiles
+	for i := 0; i < len(list); i++ {
+		p := list[i]
+		if p.Status > 0 {
+			return nil, name, StatusError(p.Status)
+		}
+		if !p.Walk {
+			if f, fname, err := s.tryPattern(p, name, "", accepted); f != nil || err != nil {
+				return f, fname, err
+			}
+			continue
+		}
+		// group consecutive directory patterns
+		j := i + 1
+		for j < len(list) && list[j].Walk {
+			j++
+		}
+		segments := strings.Split(name, "/")
+		for k := len(segments); k > 0; k-- {
+			dir := strings.Join(segments[:k], "/")
+			for _, p := range list[i:j] {
+				if f, fname, err := s.tryPattern(p, name, dir, accepted); f != nil || err != nil {
+					return f, fname, err
+				}
+			}
+		}
+		i = j - 1
+	}
+	return nil, name, StatusError(http.StatusNotFound)
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2019-2020 KIDTSUNAMI
+// Author: alex@kidtsunami.com
+
+package server
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTryFiles(t *testing.T) {
+	tests := []struct {
+		name string
+		list []string
+		want []TryPattern
+		err  string // expected error substring
+	}{
+		{
+			name: "defaults",
+			list: defaultTryFiles,
+			want: []TryPattern{
+				{Pattern: "$uri"},
+				{Pattern: "$uri.html", Ext: true},
+				{Pattern: langIndexPattern, Walk: true, Lang: true},
+				{Pattern: "$dir/$index", Walk: true},
+			},
+		},
+		{
+			name: "status last",
+			list: []string{"$uri", " =404 "},
+			want: []TryPattern{
+				{Pattern: "$uri"},
+				{Pattern: "=404", Status: 404},
+			},
+		},
+		{
+			name: "absolute path",
+			list: []string{"/index.html"},
+			want: []TryPattern{{Pattern: "/index.html"}},
+		},
+		{
+			name: "uri directory",
+			list: []string{"$uri/$index"},
+			want: []TryPattern{{Pattern: "$uri/$index"}},
+		},
+		{name: "empty", list: nil, err: "empty list"},
+		{name: "status not last", list: []string{"=404", "$uri"}, err: "must be last"},
+		{name: "status before last", list: []string{"$uri", "=404", "/index.html"}, err: "must be last"},
+		{name: "status not a number", list: []string{"=abc"}, err: "invalid status pattern"},
+		{name: "status not an error", list: []string{"=302"}, err: "invalid status pattern"},
+		{name: "uri not leading", list: []string{"/app$uri"}, err: "'$uri' must start pattern"},
+		{name: "uri twice", list: []string{"$uri$uri"}, err: "'$uri' must start pattern"},
+		{name: "dir not leading", list: []string{"/app/$dir/$index"}, err: "'$dir' must start pattern"},
+		{name: "unknown variable", list: []string{"$uri/$file"}, err: "unknown variable '$file'"},
+		{name: "relative path", list: []string{"index.html"}, err: "must be an absolute path"},
+	}
+	for _, tt := range tests {
+		got, err := ParseTryFiles(tt.list)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error = %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright (c) 2019-2020 KIDTSUNAMI
+// Author: alex@kidtsunami.com
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/echa/config"
+	"gopkg.in/yaml.v3"
+)
+
+// ValueSource resolves template variable names to values.
+type ValueSource interface {
+	Lookup(key string) (string, bool)
+}
+
+// EnvSource resolves variables from the process environment.
+type EnvSource struct{}
+
+func (EnvSource) Lookup(key string) (string, bool) {
+	return os.LookupEnv(key)
+}
+
+// DirSource resolves variables from a directory with one file per key as
+// used for Docker and Kubernetes secrets. Files are read on every lookup so
+// rotated secrets are picked up when files are reloaded. A single trailing
+// newline is removed.
+type DirSource struct {
+	Path string
+}
+
+func (s DirSource) Lookup(key string) (string, bool) {
+	// keys must not escape the directory
+	if key == "" || strings.ContainsAny(key, `/\`) || key == "." || key == ".." {
+		return "", false
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(s.Path, key))
+	if err != nil {
+		return "", false
+	}
+	buf = bytes.TrimSuffix(buf, []byte("\n"))
+	buf = bytes.TrimSuffix(buf, []byte("\r"))
+	return string(buf), true
+}
+
+// MapSource resolves variables from a JSON or YAML value file. Nested keys
+// are joined with dots, e.g. `api.url`.
+type MapSource map[string]string
+
+func (s MapSource) Lookup(key string) (string, bool) {
+	v, ok := s[key]
+	return v, ok
+}
+
+// NewFileSource loads a JSON or YAML value file. The format is selected by
+// file extension.
+func NewFileSource(name string) (MapSource, error) {
+	data, err := readValueFile(name)
+	if err != nil {
+		return nil, err
+	}
+	m := make(MapSource)
+	flatten(m, "", data)
+	return m, nil
+}
+
+// readValueFile decodes a JSON or YAML value file.
+func readValueFile(name string) (interface{}, error) {
+	buf, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var data interface{}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json":
+		err = json.Unmarshal(buf, &data)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(buf, &data)
+	default:
+		return nil, fmt.Errorf("unsupported value file type '%s'", filepath.Ext(name))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing value file %s: %v", name, err)
+	}
+	return data, nil
+}
+
+func flatten(m MapSource, prefix string, v interface{}) {
+	join := func(k string) string {
+		if prefix == "" {
+			return k
+		}
+		return prefix + "." + k
+	}
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, v := range val {
+			flatten(m, join(k), v)
+		}
+	case map[interface{}]interface{}:
+		for k, v := range val {
+			flatten(m, join(fmt.Sprint(k)), v)
+		}
+	case []interface{}:
+		buf, _ := json.Marshal(val)
+		m[prefix] = string(buf)
+	case nil:
+		m[prefix] = ""
+	default:
+		m[prefix] = fmt.Sprint(val)
+	}
+}
+
+// Values resolves template variables from a list of sources in order of
+// precedence. A variable may select sources by name with a prefix like
+// `secret:DB_PASSWORD`, otherwise all sources are searched.
+type Values struct {
+	sources []namedSource
+}
+
+type namedSource struct {
+	name string
+	src  ValueSource
+}
+
+func NewValues() *Values {
+	return &Values{}
+}
+
+// Add appends a source with lower precedence than all existing sources.
+func (v *Values) Add(name string, src ValueSource) *Values {
+	v.sources = append(v.sources, namedSource{name: name, src: src})
+	return v
+}
+
+// SplitKey splits a variable into source prefix and key.
+func SplitKey(key string) (string, string) {
+	if i := strings.Index(key, ":"); i >= 0 {
+		return key[:i], key[i+1:]
+	}
+	return "", key
+}
+
+// Lookup returns the value of a variable from the first source that defines
+// it. Variables with source prefix only search sources of this name.
+func (v *Values) Lookup(key string) (string, bool) {
+	prefix, key := SplitKey(key)
+	for _, s := range v.sources {
+		if prefix != "" && s.name != prefix {
+			continue
+		}
+		if val, ok := s.src.Lookup(key); ok {
+			return val, true
+		}
+	}
+	return "", false
+}
+
+// NewValuesFromConfig creates value sources from the `template.sources`
+// config list. Without config, variables are read from the environment.
+func NewValuesFromConfig() (*Values, error) {
+	v := NewValues()
+	if !hasConfig("template.sources") {
+		return v.Add("env", EnvSource{}), nil
+	}
+	err := config.ForEach("template.sources", func(c *config.Config) error {
+		typ := c.GetString("type")
+		name := c.GetString("name")
+		if name == "" {
+			name = typ
+		}
+		switch typ {
+		case "env":
+			v.Add(name, EnvSource{})
+		case "dir":
+			path := c.GetString("path")
+			if err := CheckDir(path); err != nil {
+				return fmt.Errorf("value source %s: %v", name, err)
+			}
+			v.Add(name, DirSource{Path: path})
+		case "file":
+			src, err := NewFileSource(c.GetString("path"))
+			if err != nil {
+				return fmt.Errorf("value source %s: %v", name, err)
+			}
+			v.Add(name, src)
+		default:
+			return fmt.Errorf("unknown value source type '%s'", typ)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// hasConfig returns true when a config path exists in config file, env or
+// defaults.
+func hasConfig(path string) bool {
+	return hasPath(config.AllSettings(), path)
+}
+
+// hasPath returns true when a path exists in a config settings tree.
+func hasPath(settings map[string]interface{}, path string) bool {
+	var v interface{} = settings
+	for _, seg := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		if v, ok = m[seg]; !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2019-2020 KIDTSUNAMI
+// Author: alex@kidtsunami.com
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/echa/log"
+)
+
+// Warmup walks the server root and loads all files matching the warmup
+// regexp into cache, replacing templates on the way. In strict mode any file
+// that cannot be read fails warmup, otherwise such files are logged and
+// skipped.
+func (s *SPAServer) Warmup() error {
+	if s.cfg.Cache.Warmup == nil {
+		return nil
+	}
+	var (
+		count int
+		size  int64
+	)
+	err := filepath.Walk(s.cfg.Root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return s.warmupError(relName(s.cfg.Root, p), err)
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		name := relName(s.cfg.Root, p)
+		if !s.cfg.Cache.Warmup.MatchString(name) {
+			return nil
+		}
+		rule := s.CacheRule(name)
+		if rule.NoMemCache {
+			return nil
+		}
+		f, err := s.root.Open(name)
+		if err != nil {
+			return s.warmupError(name, err)
+		}
+		defer f.Close()
+		cf, err := s.cache.Load(name, rule.Pin, func() (*CachedFile, error) {
+			return s.loadFile(f, name)
+		})
+		switch err {
+		case nil:
+			count++
+			size += cf.memsize()
+			return nil
+		case io.ErrShortBuffer:
+			log.Warnf("Warmup skipped file %s: file too large", name)
+			return nil
+		default:
+			return s.warmupError(name, err)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	log.Infof("Warmed up %d files (%d bytes)", count, size)
+	if s.cfg.Cache.MaxMem > 0 && size > s.cfg.Cache.MaxMem {
+		log.Warnf("Warmup size %d exceeds cache memory budget %d, some files were evicted", size, s.cfg.Cache.MaxMem)
+	}
+	return nil
+}
+
+func (s *SPAServer) warmupError(name string, err error) error {
+	if s.cfg.Cache.WarmupStrict {
+		return fmt.Errorf("warmup file %s: %v", name, err)
+	}
+	log.Warnf("Warmup skipped file %s: %v", name, err)
+	return nil
+}
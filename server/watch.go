@@ -0,0 +1,130 @@
+// Copyright (c) 2019-2020 KIDTSUNAMI
+// Author: alex@kidtsunami.com
+
+package server
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/echa/log"
+)
+
+// NewWatcher watches all files below root and calls fn with the slash
+// separated name (relative to root, with leading slash) of every file or
+// directory that was created, changed or removed. It uses kernel
+// notifications when available and falls back to polling otherwise.
+func NewWatcher(root string, poll bool, interval time.Duration, fn func(string)) (io.Closer, error) {
+	if !poll {
+		w, err := newNotifyWatcher(root, fn)
+		if err == nil {
+			log.Debugf("Watching %s for changes", root)
+			return w, nil
+		}
+		log.Warnf("File notifications unavailable, falling back to polling: %v", err)
+	}
+	log.Debugf("Polling %s for changes every %s", root, interval)
+	return newPollWatcher(root, interval, fn)
+}
+
+type fileState struct {
+	size    int64
+	modtime time.Time
+}
+
+// pollWatcher detects changes by comparing size and modification time of all
+// files below root in regular intervals.
+type pollWatcher struct {
+	root  string
+	fn    func(string)
+	files map[string]fileState
+	done  chan struct{}
+}
+
+func newPollWatcher(root string, interval time.Duration, fn func(string)) (*pollWatcher, error) {
+	if interval <= 0 {
+		interval = 2 * time.Second
+	}
+	w := &pollWatcher{
+		root: root,
+		fn:   fn,
+		done: make(chan struct{}),
+	}
+	files, err := w.scan()
+	if err != nil {
+		return nil, err
+	}
+	w.files = files
+	go w.run(interval)
+	return w, nil
+}
+
+func (w *pollWatcher) Close() error {
+	close(w.done)
+	return nil
+}
+
+func (w *pollWatcher) run(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-t.C:
+			files, err := w.scan()
+			if err != nil {
+				log.Warnf("Polling %s: %v", w.root, err)
+				continue
+			}
+			for name, s := range files {
+				if old, ok := w.files[name]; !ok || old != s {
+					w.fn(name)
+				}
+			}
+			for name := range w.files {
+				if _, ok := files[name]; !ok {
+					w.fn(name)
+				}
+			}
+			w.files = files
+		}
+	}
+}
+
+func (w *pollWatcher) scan() (map[string]fileState, error) {
+	files := make(map[string]fileState)
+	err := filepath.Walk(w.root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			// file may have vanished since the directory was read
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		// follow symlinks
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if fi, err = os.Stat(p); err != nil || fi.IsDir() {
+				return nil
+			}
+		}
+		files[relName(w.root, p)] = fileState{size: fi.Size(), modtime: fi.ModTime()}
+		return nil
+	})
+	return files, err
+}
+
+// relName converts a filesystem path below root into a slash separated name
+// with leading slash as used in URLs and cache keys.
+func relName(root, p string) string {
+	rel, err := filepath.Rel(root, p)
+	if err != nil || rel == "." {
+		return "/"
+	}
+	return "/" + filepath.ToSlash(rel)
+}
@@ -0,0 +1,156 @@
+// Copyright (c) 2019-2020 KIDTSUNAMI
+// Author: alex@kidtsunami.com
+
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/echa/log"
+)
+
+const inotifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ATTRIB |
+	syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+
+// notifyWatcher uses Linux inotify to watch all directories below root.
+type notifyWatcher struct {
+	root string
+	fn   func(string)
+	fd   int
+	file *os.File
+	mu   sync.Mutex
+	dirs map[int32]string // watch descriptor to directory name
+}
+
+func newNotifyWatcher(root string, fn func(string)) (*notifyWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	w := &notifyWatcher{
+		root: root,
+		fn:   fn,
+		fd:   fd,
+		// a non-blocking fd is handled by the runtime poller, so Close
+		// unblocks a pending Read
+		file: os.NewFile(uintptr(fd), "inotify"),
+		dirs: make(map[int32]string),
+	}
+	if err := w.addTree("/"); err != nil {
+		w.file.Close()
+		return nil, err
+	}
+	go w.run()
+	return w, nil
+}
+
+func (w *notifyWatcher) Close() error {
+	return w.file.Close()
+}
+
+// addTree adds watches for a directory and all its subdirectories.
+func (w *notifyWatcher) addTree(name string) error {
+	base := filepath.Join(w.root, filepath.FromSlash(name))
+	return filepath.Walk(base, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !fi.IsDir() {
+			return nil
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, p, inotifyMask)
+		if err != nil {
+			return os.NewSyscallError("inotify_add_watch", err)
+		}
+		w.mu.Lock()
+		w.dirs[int32(wd)] = relName(w.root, p)
+		w.mu.Unlock()
+		return nil
+	})
+}
+
+func (w *notifyWatcher) run() {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				log.Errorf("Reading file notifications: %v", err)
+			}
+			return
+		}
+		// collect unique names from all events returned by a single read
+		names := make([]string, 0)
+		seen := make(map[string]bool)
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			raw := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(ev.Len)]
+			offset += syscall.SizeofInotifyEvent + int(ev.Len)
+
+			if ev.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				log.Warn("File notification queue overflow, refreshing all files")
+				name := "/"
+				if !seen[name] {
+					seen[name] = true
+					names = append(names, name)
+				}
+				continue
+			}
+			w.mu.Lock()
+			dir, ok := w.dirs[ev.Wd]
+			if ev.Mask&syscall.IN_IGNORED != 0 {
+				delete(w.dirs, ev.Wd)
+			}
+			w.mu.Unlock()
+			if !ok {
+				continue
+			}
+			name := path.Join(dir, string(bytes.TrimRight(raw, "\x00")))
+			if ev.Mask&syscall.IN_ISDIR != 0 && ev.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+				if err := w.addTree(name); err != nil {
+					log.Warnf("Watching directory %s: %v", name, err)
+				}
+			}
+			if w.isIndirect(name) {
+				// files may be reached through the changed link under any
+				// name, like Kubernetes volumes swapping their `..data` link
+				name = "/"
+			}
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+		if seen["/"] {
+			names = []string{"/"}
+		}
+		for _, name := range names {
+			w.fn(name)
+		}
+	}
+}
+
+// isIndirect returns true when a changed name is a symlink or a hidden
+// name starting with `..` as used by atomically updated volumes.
+func (w *notifyWatcher) isIndirect(name string) bool {
+	if strings.HasPrefix(path.Base(name), "..") {
+		return true
+	}
+	fi, err := os.Lstat(filepath.Join(w.root, filepath.FromSlash(name)))
+	return err == nil && fi.Mode()&os.ModeSymlink != 0
+}
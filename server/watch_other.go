@@ -0,0 +1,16 @@
+// Copyright (c) 2019-2020 KIDTSUNAMI
+// Author: alex@kidtsunami.com
+
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"errors"
+	"io"
+)
+
+func newNotifyWatcher(root string, fn func(string)) (io.Closer, error) {
+	return nil, errors.New("not supported on this platform")
+}